@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"log"
 	"net/http"
+	"strings"
 	"time"
 
 	"ephemeral/internal/config"
@@ -17,9 +18,22 @@ import (
 
 func runMigrations(db *sql.DB) error {
 	runner := migrate.NewRunner(db, "migrations")
+	runner.AddHook(5, rooms.HashTokens)
 	return runner.Run()
 }
 
+// sqliteDSN opens path so that several processes can share the database:
+// writers wait for the lock instead of failing with SQLITE_BUSY, and
+// transactions take the write lock up front, so two read-then-write
+// transactions (like seq allocation) cannot deadlock on the upgrade.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return path + sep + "_busy_timeout=5000&_txlock=immediate"
+}
+
 func main() {
 	// Load configuration based on runtime mode
 	cfg, err := config.Load()
@@ -33,6 +47,10 @@ func main() {
 
 	log.Printf("starting ephemeral in %s mode", cfg.Mode)
 
+	// Room IDs are derived from tokens with this secret; set it before
+	// migrations so legacy tokens can be rewritten.
+	rooms.SetTokenSecret([]byte(cfg.TokenSecret))
+
 	notify.Emit("system.start", "-", "ephemeral online")
 
 	// Ensure database directory exists (important for development mode)
@@ -40,7 +58,13 @@ func main() {
 		log.Fatal("failed to create db directory:", err)
 	}
 
-	db, err := sql.Open("sqlite3", cfg.DBPath)
+	// Blob contents live in files, outside the database
+	if err := cfg.EnsureBlobDirectory(); err != nil {
+		log.Fatal("failed to create blob directory:", err)
+	}
+	rooms.SetBlobDir(cfg.BlobDir)
+
+	db, err := sql.Open("sqlite3", sqliteDSN(cfg.DBPath))
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -57,9 +81,32 @@ func main() {
 		defer ticker.Stop()
 
 		for range ticker.C {
-			if err := rooms.CleanupExpired(db); err != nil {
+			// Open connections count as activity, so a room with people
+			// in it does not go idle just because nothing is stored
+			if err := rooms.TouchConnected(db, httpx.LiveRooms()); err != nil {
+				log.Println("touching connected rooms failed:", err)
+			}
+
+			if _, err := rooms.CleanupParticipants(db, cfg.ParticipantTimeout); err != nil {
+				log.Println("participant cleanup failed:", err)
+			}
+
+			// Each cleanup runs even if the one before it failed
+			expired, err := rooms.CleanupExpired(db)
+			if err != nil {
 				log.Println("cleanup failed:", err)
 			}
+			for _, room := range expired {
+				httpx.DestroyRoom(room.ID, room.Reason)
+			}
+
+			stale, err := rooms.CleanupTransfers(db, cfg.TransferTimeout)
+			if err != nil {
+				log.Println("transfer cleanup failed:", err)
+			}
+			for _, t := range stale {
+				httpx.AbortTransfer(t.RoomID, t.TransferID)
+			}
 		}
 	}()
 
@@ -67,6 +114,6 @@ func main() {
 	log.Printf("listening on http://%s", addr)
 	log.Fatal(http.ListenAndServe(
 		addr,
-		httpx.Router(db),
+		httpx.Router(db, cfg),
 	))
 }
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Mode represents the runtime mode of the application
@@ -14,6 +17,17 @@ const (
 	ModeProduction  Mode = "production"
 )
 
+// What to do with a websocket whose send queue overflows.
+const (
+	// SlowConsumerDisconnect closes it with a "lagging" code; the client
+	// reconnects and resyncs from history.
+	SlowConsumerDisconnect = "disconnect"
+	// SlowConsumerCatchUp keeps it open and feeds it missed messages from
+	// the database until it is live again. Overflowing frames that are not
+	// stored still disconnect it.
+	SlowConsumerCatchUp = "catchup"
+)
+
 // Config holds all runtime configuration for the application
 type Config struct {
 	Mode     Mode
@@ -22,6 +36,79 @@ type Config struct {
 	DBPath   string
 	UIDir    string
 	LogLevel string
+
+	// TokenSecret keys the HMAC that turns room tokens into the room IDs
+	// stored in the database. Changing it orphans every existing room.
+	TokenSecret string
+
+	// Room TTL policy for /create. AllowedTTLs, when non-empty, restricts
+	// requests to exactly those values (each still within MinTTL..MaxTTL).
+	MinTTL      time.Duration
+	MaxTTL      time.Duration
+	DefaultTTL  time.Duration
+	AllowedTTLs []time.Duration
+
+	// MaxRoomLifetime caps how far a room's expiry can be pushed by
+	// extensions, measured from the room's creation time.
+	MaxRoomLifetime time.Duration
+
+	// Participant cap per room: rooms pick a value up to MaxParticipants
+	// at creation, DefaultParticipants when they don't.
+	MaxParticipants     int
+	DefaultParticipants int
+
+	// Per-room storage quotas for persisted messages (0 = unlimited)
+	MaxRoomMessages int
+	MaxRoomBytes    int64
+
+	// ExpiryWarnings are offsets before expires_at at which connected
+	// clients receive an EXPIRY_WARNING envelope.
+	ExpiryWarnings []time.Duration
+
+	// MaxImageBytes is advertised to clients in WELCOME as the largest
+	// image they should send. The server can only enforce it on transfers
+	// that declare their size in a plaintext header.
+	MaxImageBytes int64
+
+	// MaxBlobBytes caps a single upload to /room/{token}/blobs. Blobs also
+	// count toward MaxRoomBytes.
+	MaxBlobBytes int64
+
+	// BlobDir holds blob contents, one file each. It defaults to a blobs
+	// directory next to the database.
+	BlobDir string
+
+	// TransferTimeout is how long an incomplete image transfer may go
+	// without a new chunk before the server deletes it.
+	TransferTimeout time.Duration
+
+	// ParticipantTimeout is how long a participant of a delete-on-delivery
+	// room may stay away before the server stops keeping messages for it.
+	ParticipantTimeout time.Duration
+
+	// Websocket heartbeat: a ping every PingInterval, and a connection that
+	// does not answer within PingTimeout is dropped.
+	PingInterval time.Duration
+	PingTimeout  time.Duration
+
+	// WriteTimeout bounds each websocket write; a client that cannot take
+	// a frame within it is disconnected.
+	WriteTimeout time.Duration
+
+	// MessageTypes extends the built-in websocket message type registry.
+	MessageTypes []MessageType
+
+	// SlowConsumerPolicy is SlowConsumerDisconnect or SlowConsumerCatchUp.
+	SlowConsumerPolicy string
+
+	// Inbound websocket rate limits, per connection and per room (0 means
+	// unlimited). A connection is closed once it has RateLimitStrikes
+	// RATE_LIMITED errors outstanding; one is forgiven every second.
+	ConnMessageRate  int64
+	ConnByteRate     int64
+	RoomMessageRate  int64
+	RoomByteRate     int64
+	RateLimitStrikes int
 }
 
 // Load reads configuration from environment variables and applies
@@ -50,8 +137,17 @@ func Load() (*Config, error) {
 		cfg.applyProductionDefaults()
 	}
 
+	// Room policy defaults are the same in every mode
+	cfg.applyPolicyDefaults()
+
 	// Allow environment variables to override defaults
-	cfg.applyEnvironmentOverrides()
+	if err := cfg.applyEnvironmentOverrides(); err != nil {
+		return nil, err
+	}
+
+	if cfg.BlobDir == "" && cfg.DBPath != "" {
+		cfg.BlobDir = filepath.Join(filepath.Dir(cfg.DBPath), "blobs")
+	}
 
 	return cfg, nil
 }
@@ -63,6 +159,7 @@ func (c *Config) applyDevelopmentDefaults() {
 	c.DBPath = "./data/dev.db"
 	c.UIDir = "ui"
 	c.LogLevel = "debug"
+	c.TokenSecret = "ephemeral-development-token-secret"
 }
 
 // applyProductionDefaults ensures no implicit assumptions in production.
@@ -70,15 +167,43 @@ func (c *Config) applyDevelopmentDefaults() {
 func (c *Config) applyProductionDefaults() {
 	// Production mode requires explicit configuration
 	// These are placeholders that will be overridden by environment variables
-	c.Host = ""   // Must be set via EPHEMERAL_HOST
-	c.Port = ""   // Must be set via EPHEMERAL_PORT
-	c.DBPath = "" // Must be set via EPHEMERAL_DB_PATH
+	c.Host = ""        // Must be set via EPHEMERAL_HOST
+	c.Port = ""        // Must be set via EPHEMERAL_PORT
+	c.DBPath = ""      // Must be set via EPHEMERAL_DB_PATH
+	c.TokenSecret = "" // Must be set via EPHEMERAL_TOKEN_SECRET
 	c.UIDir = "ui"
 	c.LogLevel = "info"
 }
 
+// applyPolicyDefaults sets room lifetime limits shared by all modes
+func (c *Config) applyPolicyDefaults() {
+	c.MinTTL = 1 * time.Minute
+	c.MaxTTL = 24 * time.Hour
+	c.DefaultTTL = 1 * time.Hour
+	c.AllowedTTLs = nil
+	c.MaxRoomLifetime = 72 * time.Hour
+	c.MaxParticipants = 8
+	c.DefaultParticipants = 2
+	c.MaxRoomMessages = 10000
+	c.MaxRoomBytes = 64 * 1024 * 1024
+	c.ExpiryWarnings = []time.Duration{5 * time.Minute, time.Minute}
+	c.MaxImageBytes = 5 * 1024 * 1024
+	c.TransferTimeout = 10 * time.Minute
+	c.ParticipantTimeout = 24 * time.Hour
+	c.MaxBlobBytes = 8 * 1024 * 1024
+	c.PingInterval = 20 * time.Second
+	c.PingTimeout = 10 * time.Second
+	c.WriteTimeout = 10 * time.Second
+	c.SlowConsumerPolicy = SlowConsumerDisconnect
+	c.ConnMessageRate = 100
+	c.ConnByteRate = 4 * 1024 * 1024
+	c.RoomMessageRate = 300
+	c.RoomByteRate = 16 * 1024 * 1024
+	c.RateLimitStrikes = 20
+}
+
 // applyEnvironmentOverrides allows environment variables to override defaults
-func (c *Config) applyEnvironmentOverrides() {
+func (c *Config) applyEnvironmentOverrides() error {
 	if host := os.Getenv("EPHEMERAL_HOST"); host != "" {
 		c.Host = host
 	}
@@ -88,12 +213,158 @@ func (c *Config) applyEnvironmentOverrides() {
 	if dbPath := os.Getenv("EPHEMERAL_DB_PATH"); dbPath != "" {
 		c.DBPath = dbPath
 	}
+	if blobDir := os.Getenv("EPHEMERAL_BLOB_DIR"); blobDir != "" {
+		c.BlobDir = blobDir
+	}
 	if uiDir := os.Getenv("EPHEMERAL_UI_DIR"); uiDir != "" {
 		c.UIDir = uiDir
 	}
 	if logLevel := os.Getenv("EPHEMERAL_LOG_LEVEL"); logLevel != "" {
 		c.LogLevel = logLevel
 	}
+	if secret := os.Getenv("EPHEMERAL_TOKEN_SECRET"); secret != "" {
+		c.TokenSecret = secret
+	}
+	if err := durationEnv("EPHEMERAL_MIN_TTL", &c.MinTTL); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_MAX_TTL", &c.MaxTTL); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_DEFAULT_TTL", &c.DefaultTTL); err != nil {
+		return err
+	}
+	if err := durationListEnv("EPHEMERAL_ALLOWED_TTLS", &c.AllowedTTLs); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_MAX_ROOM_LIFETIME", &c.MaxRoomLifetime); err != nil {
+		return err
+	}
+	if err := intEnv("EPHEMERAL_MAX_PARTICIPANTS", &c.MaxParticipants); err != nil {
+		return err
+	}
+	if err := intEnv("EPHEMERAL_DEFAULT_PARTICIPANTS", &c.DefaultParticipants); err != nil {
+		return err
+	}
+	if err := intEnv("EPHEMERAL_MAX_ROOM_MESSAGES", &c.MaxRoomMessages); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_MAX_ROOM_BYTES", &c.MaxRoomBytes); err != nil {
+		return err
+	}
+	if err := durationListEnv("EPHEMERAL_EXPIRY_WARNINGS", &c.ExpiryWarnings); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_MAX_IMAGE_BYTES", &c.MaxImageBytes); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_MAX_BLOB_BYTES", &c.MaxBlobBytes); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_PING_INTERVAL", &c.PingInterval); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_PING_TIMEOUT", &c.PingTimeout); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_TRANSFER_TIMEOUT", &c.TransferTimeout); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_PARTICIPANT_TIMEOUT", &c.ParticipantTimeout); err != nil {
+		return err
+	}
+	if err := durationEnv("EPHEMERAL_WRITE_TIMEOUT", &c.WriteTimeout); err != nil {
+		return err
+	}
+	if err := messageTypesEnv("EPHEMERAL_MESSAGE_TYPES", &c.MessageTypes); err != nil {
+		return err
+	}
+	if policy := os.Getenv("EPHEMERAL_SLOW_CONSUMER"); policy != "" {
+		c.SlowConsumerPolicy = policy
+	}
+	if err := int64Env("EPHEMERAL_CONN_MSG_RATE", &c.ConnMessageRate); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_CONN_BYTE_RATE", &c.ConnByteRate); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_ROOM_MSG_RATE", &c.RoomMessageRate); err != nil {
+		return err
+	}
+	if err := int64Env("EPHEMERAL_ROOM_BYTE_RATE", &c.RoomByteRate); err != nil {
+		return err
+	}
+	if err := intEnv("EPHEMERAL_RATE_LIMIT_STRIKES", &c.RateLimitStrikes); err != nil {
+		return err
+	}
+	return nil
+}
+
+// intEnv parses an integer from the named environment variable into dst,
+// leaving dst untouched when unset.
+func intEnv(name string, dst *int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+// int64Env is intEnv for byte counts and other 64-bit values.
+func int64Env(name string, dst *int64) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = n
+	return nil
+}
+
+// durationEnv parses a Go duration (e.g. "90m", "72h") from the named
+// environment variable into dst, leaving dst untouched when unset.
+func durationEnv(name string, dst *time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("invalid %s: %w", name, err)
+	}
+	*dst = d
+	return nil
+}
+
+// durationListEnv parses a comma-separated list of Go durations
+// (e.g. "15m,1h,24h") from the named environment variable.
+func durationListEnv(name string, dst *[]time.Duration) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	var list []time.Duration
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", name, err)
+		}
+		list = append(list, d)
+	}
+	*dst = list
+	return nil
 }
 
 // Validate ensures all required configuration is present
@@ -107,9 +378,97 @@ func (c *Config) Validate() error {
 	if c.DBPath == "" {
 		return fmt.Errorf("EPHEMERAL_DB_PATH must be set in %s mode", c.Mode)
 	}
+	if c.TokenSecret == "" {
+		return fmt.Errorf("EPHEMERAL_TOKEN_SECRET must be set in %s mode", c.Mode)
+	}
+	if c.Mode == ModeProduction && len(c.TokenSecret) < 32 {
+		return fmt.Errorf("EPHEMERAL_TOKEN_SECRET must be at least 32 characters in production")
+	}
+	if c.MinTTL <= 0 {
+		return fmt.Errorf("EPHEMERAL_MIN_TTL must be positive")
+	}
+	if c.MaxTTL < c.MinTTL {
+		return fmt.Errorf("EPHEMERAL_MAX_TTL (%s) is below EPHEMERAL_MIN_TTL (%s)", c.MaxTTL, c.MinTTL)
+	}
+	for _, ttl := range c.AllowedTTLs {
+		if ttl < c.MinTTL || ttl > c.MaxTTL {
+			return fmt.Errorf("EPHEMERAL_ALLOWED_TTLS value %s is outside %s..%s", ttl, c.MinTTL, c.MaxTTL)
+		}
+	}
+	if err := c.CheckTTL(c.DefaultTTL); err != nil {
+		return fmt.Errorf("EPHEMERAL_DEFAULT_TTL: %w", err)
+	}
+	if c.MaxRoomLifetime < c.MaxTTL {
+		return fmt.Errorf("EPHEMERAL_MAX_ROOM_LIFETIME (%s) is below EPHEMERAL_MAX_TTL (%s)", c.MaxRoomLifetime, c.MaxTTL)
+	}
+	if c.MaxParticipants < 1 {
+		return fmt.Errorf("EPHEMERAL_MAX_PARTICIPANTS must be at least 1")
+	}
+	if c.DefaultParticipants < 1 || c.DefaultParticipants > c.MaxParticipants {
+		return fmt.Errorf("EPHEMERAL_DEFAULT_PARTICIPANTS must be between 1 and %d", c.MaxParticipants)
+	}
+	if c.MaxRoomMessages < 0 || c.MaxRoomBytes < 0 {
+		return fmt.Errorf("room quotas must not be negative (use 0 for unlimited)")
+	}
+	for _, offset := range c.ExpiryWarnings {
+		if offset <= 0 {
+			return fmt.Errorf("EPHEMERAL_EXPIRY_WARNINGS entries must be positive")
+		}
+	}
+	if c.MaxImageBytes <= 0 {
+		return fmt.Errorf("EPHEMERAL_MAX_IMAGE_BYTES must be positive")
+	}
+	if c.MaxBlobBytes <= 0 {
+		return fmt.Errorf("EPHEMERAL_MAX_BLOB_BYTES must be positive")
+	}
+	if c.TransferTimeout <= 0 {
+		return fmt.Errorf("EPHEMERAL_TRANSFER_TIMEOUT must be positive")
+	}
+	if c.ParticipantTimeout <= 0 {
+		return fmt.Errorf("EPHEMERAL_PARTICIPANT_TIMEOUT must be positive")
+	}
+	if c.PingInterval <= 0 || c.PingTimeout <= 0 {
+		return fmt.Errorf("EPHEMERAL_PING_INTERVAL and EPHEMERAL_PING_TIMEOUT must be positive")
+	}
+	if c.WriteTimeout <= 0 {
+		return fmt.Errorf("EPHEMERAL_WRITE_TIMEOUT must be positive")
+	}
+	if c.SlowConsumerPolicy != SlowConsumerDisconnect && c.SlowConsumerPolicy != SlowConsumerCatchUp {
+		return fmt.Errorf("EPHEMERAL_SLOW_CONSUMER must be %q or %q", SlowConsumerDisconnect, SlowConsumerCatchUp)
+	}
+	if c.ConnMessageRate < 0 || c.ConnByteRate < 0 || c.RoomMessageRate < 0 || c.RoomByteRate < 0 {
+		return fmt.Errorf("websocket rate limits cannot be negative")
+	}
+	if c.RateLimitStrikes < 1 {
+		return fmt.Errorf("EPHEMERAL_RATE_LIMIT_STRIKES must be at least 1")
+	}
+	for _, mt := range c.MessageTypes {
+		if !validTypeName(mt.Name) {
+			return fmt.Errorf("EPHEMERAL_MESSAGE_TYPES: invalid type name %q", mt.Name)
+		}
+	}
 	return nil
 }
 
+// CheckTTL reports whether a requested room TTL is allowed by policy
+func (c *Config) CheckTTL(ttl time.Duration) error {
+	if ttl < c.MinTTL {
+		return fmt.Errorf("ttl %s is below the minimum of %s", ttl, c.MinTTL)
+	}
+	if ttl > c.MaxTTL {
+		return fmt.Errorf("ttl %s exceeds the maximum of %s", ttl, c.MaxTTL)
+	}
+	if len(c.AllowedTTLs) == 0 {
+		return nil
+	}
+	for _, allowed := range c.AllowedTTLs {
+		if ttl == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("ttl %s is not one of the allowed values", ttl)
+}
+
 // Address returns the full host:port address for the HTTP server
 func (c *Config) Address() string {
 	return fmt.Sprintf("%s:%s", c.Host, c.Port)
@@ -123,3 +482,9 @@ func (c *Config) EnsureDBDirectory() error {
 	}
 	return os.MkdirAll(dir, 0755)
 }
+
+// EnsureBlobDirectory creates the blob directory if it doesn't exist. It
+// is private to the server: blobs are only served through the room API.
+func (c *Config) EnsureBlobDirectory() error {
+	return os.MkdirAll(c.BlobDir, 0700)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// MessageType is an operator-defined websocket envelope type, added to the
+// server's built-in registry.
+type MessageType struct {
+	Name            string
+	Persist         bool
+	Relay           bool
+	BeforeHandshake bool
+	MaxPayload      int // bytes of the "d" field; 0 means only the frame limit applies
+}
+
+// messageTypesEnv parses EPHEMERAL_MESSAGE_TYPES-style lists:
+//
+//	NAME:flags[:max_bytes];NAME:flags...
+//
+// where flags is a "+"-joined subset of relay, persist and prehandshake
+// (or "none"), e.g. "TYPING:relay:256;REACTION:relay+persist:4096".
+func messageTypesEnv(name string, dst *[]MessageType) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	var list []MessageType
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.Split(entry, ":")
+		if len(parts) < 2 || len(parts) > 3 {
+			return fmt.Errorf("invalid %s entry %q: want NAME:flags[:max_bytes]", name, entry)
+		}
+
+		mt := MessageType{Name: strings.TrimSpace(parts[0])}
+		for _, flag := range strings.Split(parts[1], "+") {
+			switch strings.TrimSpace(flag) {
+			case "relay":
+				mt.Relay = true
+			case "persist":
+				mt.Persist = true
+			case "prehandshake":
+				mt.BeforeHandshake = true
+			case "none":
+			default:
+				return fmt.Errorf("invalid %s entry %q: unknown flag %q", name, entry, flag)
+			}
+		}
+		if len(parts) == 3 {
+			n, err := strconv.Atoi(strings.TrimSpace(parts[2]))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid %s entry %q: bad max_bytes", name, entry)
+			}
+			mt.MaxPayload = n
+		}
+		list = append(list, mt)
+	}
+	*dst = list
+	return nil
+}
+
+// validTypeName reports whether name looks like an envelope type
+// (upper-case letters, digits and underscores).
+func validTypeName(name string) bool {
+	if name == "" || len(name) > 32 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,125 @@
+package httpx
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"ephemeral/internal/config"
+	"ephemeral/internal/rooms"
+)
+
+// blobHandler serves /room/{token}/blobs: PUT stores the request body as
+// an opaque blob and returns its id, GET /room/{token}/blobs/{id} returns
+// it with Range support. Like the websocket, both only need the room token;
+// the bytes are encrypted by clients with keys the server never sees.
+func blobHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, cfg *config.Config, token, id string) {
+	if strings.Contains(id, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case id == "" && r.Method == http.MethodPut:
+		putBlob(w, r, db, cfg, token)
+	case id != "" && (r.Method == http.MethodGet || r.Method == http.MethodHead):
+		getBlob(w, r, db, token, id)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
+
+func putBlob(w http.ResponseWriter, r *http.Request, db *sql.DB, cfg *config.Config, token string) {
+	room, err := rooms.Get(db, token)
+	if errors.Is(err, rooms.ErrNotFound) {
+		writeJSONError(w, 404, "ROOM_NOT_FOUND", "room not found or expired")
+		return
+	}
+	if err != nil {
+		log.Println("rooms.Get failed:", err)
+		writeJSONError(w, 500, "SERVER_ERROR", "failed to store blob")
+		return
+	}
+	// Relay-only rooms store nothing, uploads included
+	if room.RelayOnly {
+		writeJSONError(w, 409, "PERSISTENCE_DISABLED", "room does not store data")
+		return
+	}
+
+	if r.ContentLength > cfg.MaxBlobBytes {
+		writeJSONError(w, 413, "BLOB_TOO_LARGE", "blob exceeds the maximum size")
+		return
+	}
+
+	// The body streams to storage; it is never held in memory
+	body := http.MaxBytesReader(w, r.Body, cfg.MaxBlobBytes)
+	id, size, err := rooms.PutBlob(db, token, body, rooms.Quota{MaxBytes: cfg.MaxRoomBytes})
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeJSONError(w, 413, "BLOB_TOO_LARGE", "blob exceeds the maximum size")
+		return
+	case errors.Is(err, rooms.ErrBlobBody):
+		writeJSONError(w, 400, "INVALID_REQUEST", "failed to read body")
+		return
+	case errors.Is(err, rooms.ErrBlobEmpty):
+		writeJSONError(w, 400, "INVALID_REQUEST", "blob is empty")
+		return
+	case errors.Is(err, rooms.ErrNotFound):
+		writeJSONError(w, 404, "ROOM_NOT_FOUND", "room not found or expired")
+		return
+	case errors.Is(err, rooms.ErrQuotaExceeded):
+		writeJSONError(w, 507, "QUOTA_EXCEEDED", err.Error())
+		return
+	case err != nil:
+		log.Println("rooms.PutBlob failed:", err)
+		writeJSONError(w, 500, "SERVER_ERROR", "failed to store blob")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/room/"+token+"/blobs/"+id)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{
+		"id":   id,
+		"size": size,
+	})
+}
+
+func getBlob(w http.ResponseWriter, r *http.Request, db *sql.DB, token, id string) {
+	if !rooms.ValidBlobID(id) {
+		http.NotFound(w, r)
+		return
+	}
+
+	live, err := rooms.Exists(db, token)
+	if err != nil {
+		log.Println("rooms.Exists failed:", err)
+		http.Error(w, "failed to load blob", 500)
+		return
+	}
+	if !live {
+		http.Error(w, "room not found or expired", 404)
+		return
+	}
+
+	blob, err := rooms.OpenBlob(db, token, id)
+	if errors.Is(err, rooms.ErrBlobNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("rooms.OpenBlob failed:", err)
+		http.Error(w, "failed to load blob", 500)
+		return
+	}
+	defer blob.Close()
+
+	// ServeContent seeks to each requested range, so only those bytes are read
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	http.ServeContent(w, r, "", blob.CreatedAt, blob.Content())
+}
@@ -0,0 +1,53 @@
+package httpx
+
+import (
+	"database/sql"
+	"math"
+	"sync"
+
+	"ephemeral/internal/rooms"
+	"ephemeral/internal/ws"
+)
+
+// catchUp feeds a lagging conn the persisted messages after afterSeq from
+// the database, as fast as its queue drains, and switches it back to live
+// delivery once nothing newer is stored. own holds seqs conn sent itself
+// while lagging, which it must not receive back.
+func (rh *roomHub) catchUp(db *sql.DB, token string, conn *ws.Conn, afterSeq int, own *sync.Map) error {
+	cursor := afterSeq
+	for {
+		// Under order no message is stored and relayed mid-read, so an
+		// empty page means conn is current, and own already lists conn's
+		// rows by the time they can be read
+		rh.order.Lock()
+		rows, err := rooms.GetMessagesPage(db, token, cursor, math.MaxInt, defaultHistoryPage)
+		if err == nil && len(rows) == 0 {
+			conn.StopLagging()
+		}
+		rh.order.Unlock()
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		for _, row := range rows {
+			cursor = row.Seq
+			if _, mine := own.LoadAndDelete(row.Seq); mine {
+				continue
+			}
+			out, err := historyFrame(conn, row)
+			if err != nil {
+				return err
+			}
+			conn.EnqueueFrameReliable(out)
+		}
+
+		select {
+		case <-conn.Done():
+			return nil
+		default:
+		}
+	}
+}
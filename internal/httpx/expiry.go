@@ -0,0 +1,75 @@
+package httpx
+
+import (
+	"time"
+)
+
+// scheduleExpiry replaces the room's expiry timers: one EXPIRY_WARNING per
+// configured offset that is still in the future, then ROOM_EXPIRED and
+// close at expiresAt itself.
+func (rh *roomHub) scheduleExpiry(roomID string, expiresAt time.Time, warnings []time.Duration) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	rh.stopTimersLocked()
+	gen := rh.timerGen
+
+	for _, offset := range warnings {
+		at := expiresAt.Add(-offset)
+		if !at.After(time.Now()) {
+			continue
+		}
+		rh.timers = append(rh.timers, time.AfterFunc(time.Until(at), func() {
+			if !rh.timerCurrent(gen) {
+				return
+			}
+			msg, err := marshalEnvelope("EXPIRY_WARNING", expiryPayload(expiresAt))
+			if err != nil {
+				return
+			}
+			rh.hub.BroadcastControl(msg, nil)
+		}))
+	}
+
+	rh.timers = append(rh.timers, time.AfterFunc(time.Until(expiresAt), func() {
+		if !rh.timerCurrent(gen) {
+			return
+		}
+		DestroyRoom(roomID, DestroyReasonExpired)
+	}))
+}
+
+// stopExpiry cancels any pending expiry timers.
+func (rh *roomHub) stopExpiry() {
+	rh.mu.Lock()
+	rh.stopTimersLocked()
+	rh.mu.Unlock()
+}
+
+func (rh *roomHub) stopTimersLocked() {
+	for _, t := range rh.timers {
+		t.Stop()
+	}
+	rh.timers = nil
+	rh.timerGen++
+}
+
+// timerCurrent reports whether a timer from generation gen has not been
+// superseded by a later schedule (Stop cannot recall a timer already firing).
+func (rh *roomHub) timerCurrent(gen int) bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	return rh.timerGen == gen
+}
+
+// rescheduleExpiry moves a live room's timers to a new expiry, e.g. after
+// an extension.
+func rescheduleExpiry(roomID string, expiresAt time.Time, warnings []time.Duration) {
+	hubsMu.Lock()
+	rh := hubs[roomID]
+	hubsMu.Unlock()
+
+	if rh != nil {
+		rh.scheduleExpiry(roomID, expiresAt, warnings)
+	}
+}
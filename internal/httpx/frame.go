@@ -0,0 +1,181 @@
+package httpx
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+
+	"ephemeral/internal/rooms"
+)
+
+// Binary frames carry persisted message types without JSON or base64:
+//
+//	[type u8][seq u32 BE][tidLen u8][tid][nonceLen u8][nonce][ciphertext...]
+//
+// Clients send seq 0; the server fills in the assigned seq when relaying
+// and replaying. A connection receives binary frames only after asking for
+// them with "frames": "binary" in READY.
+//
+// Frames from the server also name the sending participant. They set
+// frameFlagFrom in the type byte and insert [fromLen u8][from] after seq.
+//
+// Clients may set frameFlagID to insert [idLen u8][id] after seq: their
+// own message id, echoed in the ACK or ERROR for the frame.
+//
+// Clients may set frameFlagTransfer on IMG_META and IMG_CHUNK to add a
+// plaintext transfer header after the transfer id: [size u32][chunks u32]
+// on IMG_META and [index u32] on IMG_CHUNK. The server tracks the transfer
+// with it and does not pass it on.
+//
+// BlobID is never part of a binary frame: only JSON envelopes can name a
+// blob for their message to own.
+type binaryFrame struct {
+	Type       string
+	Seq        int
+	From       string
+	ClientID   string
+	TransferID string
+	Transfer   *rooms.TransferHeader
+	BlobID     string
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+var frameTypeCodes = map[string]byte{
+	"MSG":       0x01,
+	"IMG_META":  0x02,
+	"IMG_CHUNK": 0x03,
+	"IMG_END":   0x04,
+}
+
+var frameTypeNames = map[byte]string{
+	0x01: "MSG",
+	0x02: "IMG_META",
+	0x03: "IMG_CHUNK",
+	0x04: "IMG_END",
+}
+
+const (
+	frameFlagFrom     = 0x80
+	frameFlagTransfer = 0x40
+	frameFlagID       = 0x20
+)
+
+var errInvalidFrame = errors.New("invalid binary frame")
+
+func decodeFrame(data []byte) (*binaryFrame, error) {
+	if len(data) < 6 {
+		return nil, errInvalidFrame
+	}
+	msgType, ok := frameTypeNames[data[0]&^(frameFlagFrom|frameFlagTransfer|frameFlagID)]
+	if !ok {
+		return nil, errInvalidFrame
+	}
+	f := &binaryFrame{
+		Type: msgType,
+		Seq:  int(binary.BigEndian.Uint32(data[1:5])),
+	}
+
+	rest := data[5:]
+	if data[0]&frameFlagFrom != 0 {
+		fromLen := int(rest[0])
+		rest = rest[1:]
+		if len(rest) < fromLen+1 {
+			return nil, errInvalidFrame
+		}
+		f.From = string(rest[:fromLen])
+		rest = rest[fromLen:]
+	}
+	if data[0]&frameFlagID != 0 {
+		idLen := int(rest[0])
+		rest = rest[1:]
+		if len(rest) < idLen+1 {
+			return nil, errInvalidFrame
+		}
+		f.ClientID = string(rest[:idLen])
+		rest = rest[idLen:]
+	}
+	tidLen := int(rest[0])
+	rest = rest[1:]
+	if len(rest) < tidLen+1 {
+		return nil, errInvalidFrame
+	}
+	f.TransferID = string(rest[:tidLen])
+	rest = rest[tidLen:]
+
+	if data[0]&frameFlagTransfer != 0 {
+		switch {
+		case msgType == rooms.TransferStart && len(rest) >= 9:
+			f.Transfer = &rooms.TransferHeader{
+				Size:   int64(binary.BigEndian.Uint32(rest[0:4])),
+				Chunks: int(binary.BigEndian.Uint32(rest[4:8])),
+			}
+			rest = rest[8:]
+		case msgType == rooms.TransferChunk && len(rest) >= 5:
+			f.Transfer = &rooms.TransferHeader{Index: int(binary.BigEndian.Uint32(rest[0:4]))}
+			rest = rest[4:]
+		default:
+			return nil, errInvalidFrame
+		}
+	}
+
+	nonceLen := int(rest[0])
+	rest = rest[1:]
+	if nonceLen == 0 || len(rest) <= nonceLen {
+		return nil, errInvalidFrame
+	}
+	f.Nonce = rest[:nonceLen]
+	f.Ciphertext = rest[nonceLen:]
+	return f, nil
+}
+
+func encodeFrame(f *binaryFrame) ([]byte, error) {
+	code, ok := frameTypeCodes[f.Type]
+	if !ok || len(f.From) > 255 || len(f.TransferID) > 255 || len(f.Nonce) > 255 || f.Seq < 0 {
+		return nil, errInvalidFrame
+	}
+	out := make([]byte, 0, 8+len(f.From)+len(f.TransferID)+len(f.Nonce)+len(f.Ciphertext))
+	if f.From != "" {
+		code |= frameFlagFrom
+	}
+	out = append(out, code)
+	out = binary.BigEndian.AppendUint32(out, uint32(f.Seq))
+	if f.From != "" {
+		out = append(out, byte(len(f.From)))
+		out = append(out, f.From...)
+	}
+	out = append(out, byte(len(f.TransferID)))
+	out = append(out, f.TransferID...)
+	out = append(out, byte(len(f.Nonce)))
+	out = append(out, f.Nonce...)
+	out = append(out, f.Ciphertext...)
+	return out, nil
+}
+
+// textFrame renders f as the JSON envelope used for history replay and for
+// peers that did not negotiate binary frames.
+func textFrame(f *binaryFrame) ([]byte, error) {
+	type textPayload struct {
+		Version    int    `json:"v"`
+		Seq        int    `json:"seq"`
+		TransferID string `json:"tid,omitempty"`
+		Nonce      string `json:"n"`
+		Ciphertext string `json:"c"`
+	}
+	return json.Marshal(struct {
+		Type string      `json:"t"`
+		From string      `json:"from,omitempty"`
+		Data textPayload `json:"d"`
+	}{
+		Type: f.Type,
+		From: f.From,
+		Data: textPayload{
+			Version:    protocolVersion,
+			Seq:        f.Seq,
+			TransferID: f.TransferID,
+			Nonce:      base64.RawURLEncoding.EncodeToString(f.Nonce),
+			Ciphertext: base64.RawURLEncoding.EncodeToString(f.Ciphertext),
+		},
+	})
+}
@@ -0,0 +1,248 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"ephemeral/internal/rooms"
+)
+
+// frameBytes assembles a raw frame from its parts.
+func frameBytes(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func u32(v uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, v)
+}
+
+func lenPrefixed(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func TestDecodeFrame(t *testing.T) {
+	nonce := bytes.Repeat([]byte{0xaa}, 24)
+	body := frameBytes(lenPrefixed(string(nonce)), []byte("cipher"))
+
+	tests := []struct {
+		name     string
+		data     []byte
+		want     *binaryFrame
+		wantFail bool
+	}{
+		{
+			name: "plain",
+			data: frameBytes([]byte{0x01}, u32(0), lenPrefixed(""), body),
+			want: &binaryFrame{Type: "MSG"},
+		},
+		{
+			name: "seq and transfer id",
+			data: frameBytes([]byte{0x04}, u32(7), lenPrefixed("t1"), body),
+			want: &binaryFrame{Type: "IMG_END", Seq: 7, TransferID: "t1"},
+		},
+		{
+			name: "from",
+			data: frameBytes([]byte{0x01 | frameFlagFrom}, u32(3), lenPrefixed("peer"), lenPrefixed(""), body),
+			want: &binaryFrame{Type: "MSG", Seq: 3, From: "peer"},
+		},
+		{
+			name: "client id",
+			data: frameBytes([]byte{0x01 | frameFlagID}, u32(0), lenPrefixed("m1"), lenPrefixed(""), body),
+			want: &binaryFrame{Type: "MSG", ClientID: "m1"},
+		},
+		{
+			name: "from and client id",
+			data: frameBytes([]byte{0x01 | frameFlagFrom | frameFlagID}, u32(0), lenPrefixed("peer"), lenPrefixed("m1"), lenPrefixed(""), body),
+			want: &binaryFrame{Type: "MSG", From: "peer", ClientID: "m1"},
+		},
+		{
+			name: "transfer header on IMG_META",
+			data: frameBytes([]byte{0x02 | frameFlagTransfer}, u32(0), lenPrefixed("t1"), u32(1000), u32(4), body),
+			want: &binaryFrame{Type: "IMG_META", TransferID: "t1", Transfer: &rooms.TransferHeader{Size: 1000, Chunks: 4}},
+		},
+		{
+			name: "transfer header on IMG_CHUNK",
+			data: frameBytes([]byte{0x03 | frameFlagTransfer}, u32(0), lenPrefixed("t1"), u32(2), body),
+			want: &binaryFrame{Type: "IMG_CHUNK", TransferID: "t1", Transfer: &rooms.TransferHeader{Index: 2}},
+		},
+		{
+			name: "all flags",
+			data: frameBytes([]byte{0x03 | frameFlagFrom | frameFlagID | frameFlagTransfer}, u32(9), lenPrefixed("peer"), lenPrefixed("m1"), lenPrefixed("t1"), u32(2), body),
+			want: &binaryFrame{Type: "IMG_CHUNK", Seq: 9, From: "peer", ClientID: "m1", TransferID: "t1", Transfer: &rooms.TransferHeader{Index: 2}},
+		},
+		{
+			name:     "transfer header on MSG",
+			data:     frameBytes([]byte{0x01 | frameFlagTransfer}, u32(0), lenPrefixed(""), u32(2), body),
+			wantFail: true,
+		},
+		{
+			name:     "transfer header on IMG_END",
+			data:     frameBytes([]byte{0x04 | frameFlagTransfer}, u32(0), lenPrefixed("t1"), u32(2), body),
+			wantFail: true,
+		},
+		{
+			name:     "unknown type",
+			data:     frameBytes([]byte{0x09}, u32(0), lenPrefixed(""), body),
+			wantFail: true,
+		},
+		{
+			name:     "too short",
+			data:     []byte{0x01, 0, 0, 0, 0},
+			wantFail: true,
+		},
+		{
+			name:     "empty nonce",
+			data:     frameBytes([]byte{0x01}, u32(0), lenPrefixed(""), []byte{0}, []byte("cipher")),
+			wantFail: true,
+		},
+		{
+			name:     "no ciphertext",
+			data:     frameBytes([]byte{0x01}, u32(0), lenPrefixed(""), lenPrefixed(string(nonce))),
+			wantFail: true,
+		},
+		{
+			name:     "from longer than frame",
+			data:     frameBytes([]byte{0x01 | frameFlagFrom}, u32(0), []byte{200}, []byte("peer")),
+			wantFail: true,
+		},
+		{
+			name:     "client id longer than frame",
+			data:     frameBytes([]byte{0x01 | frameFlagID}, u32(0), []byte{200}, []byte("m1")),
+			wantFail: true,
+		},
+		{
+			name:     "transfer id longer than frame",
+			data:     frameBytes([]byte{0x01}, u32(0), []byte{200}, []byte("t1")),
+			wantFail: true,
+		},
+		{
+			name:     "truncated transfer header",
+			data:     frameBytes([]byte{0x02 | frameFlagTransfer}, u32(0), lenPrefixed("t1"), u32(1000), []byte{0}),
+			wantFail: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFrame(tt.data)
+			if tt.wantFail {
+				if err == nil {
+					t.Fatalf("decodeFrame succeeded, want error: %+v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("decodeFrame: %v", err)
+			}
+			tt.want.Nonce = nonce
+			tt.want.Ciphertext = []byte("cipher")
+			assertFrame(t, got, tt.want)
+		})
+	}
+}
+
+// Every prefix of a valid frame must decode or fail cleanly, never panic,
+// and a prefix that cuts into the header must fail.
+func TestDecodeFrameTruncated(t *testing.T) {
+	full := frameBytes(
+		[]byte{0x03 | frameFlagFrom | frameFlagID | frameFlagTransfer}, u32(9),
+		lenPrefixed("peer"), lenPrefixed("m1"), lenPrefixed("t1"), u32(2),
+		lenPrefixed("nonce"), []byte("cipher"),
+	)
+	header := len(full) - len("cipher")
+
+	for n := 0; n < len(full); n++ {
+		_, err := decodeFrame(full[:n])
+		if n <= header && err == nil {
+			t.Errorf("decodeFrame accepted a frame cut to %d bytes", n)
+		}
+	}
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	tests := []*binaryFrame{
+		{Type: "MSG", Seq: 1, Nonce: []byte("n"), Ciphertext: []byte("c")},
+		{Type: "MSG", Seq: 1 << 31, From: "peer", Nonce: []byte("nonce"), Ciphertext: []byte("ciphertext")},
+		{Type: "IMG_META", Seq: 2, From: "peer", TransferID: "t1", Nonce: []byte("n"), Ciphertext: []byte("c")},
+		{Type: "IMG_CHUNK", Seq: 3, TransferID: "t1", Nonce: bytes.Repeat([]byte{1}, 255), Ciphertext: []byte("c")},
+		{Type: "IMG_END", Seq: 0, TransferID: "t1", Nonce: []byte("n"), Ciphertext: []byte("c")},
+	}
+
+	for _, want := range tests {
+		t.Run(want.Type, func(t *testing.T) {
+			data, err := encodeFrame(want)
+			if err != nil {
+				t.Fatalf("encodeFrame: %v", err)
+			}
+			got, err := decodeFrame(data)
+			if err != nil {
+				t.Fatalf("decodeFrame: %v", err)
+			}
+			assertFrame(t, got, want)
+		})
+	}
+}
+
+// The client id and transfer header are client-to-server only and are
+// never re-encoded.
+func TestEncodeFrameDropsClientFields(t *testing.T) {
+	f := &binaryFrame{
+		Type:       "IMG_CHUNK",
+		ClientID:   "m1",
+		TransferID: "t1",
+		Transfer:   &rooms.TransferHeader{Index: 2},
+		Nonce:      []byte("n"),
+		Ciphertext: []byte("c"),
+	}
+	data, err := encodeFrame(f)
+	if err != nil {
+		t.Fatalf("encodeFrame: %v", err)
+	}
+	if data[0]&(frameFlagID|frameFlagTransfer) != 0 {
+		t.Fatalf("encoded type byte %#x sets client-only flags", data[0])
+	}
+	got, err := decodeFrame(data)
+	if err != nil {
+		t.Fatalf("decodeFrame: %v", err)
+	}
+	if got.ClientID != "" || got.Transfer != nil {
+		t.Fatalf("client fields survived encoding: %+v", got)
+	}
+}
+
+func TestEncodeFrameRejects(t *testing.T) {
+	long := string(bytes.Repeat([]byte{'x'}, 256))
+	tests := []struct {
+		name string
+		f    *binaryFrame
+	}{
+		{"unknown type", &binaryFrame{Type: "CHAT"}},
+		{"negative seq", &binaryFrame{Type: "MSG", Seq: -1}},
+		{"long from", &binaryFrame{Type: "MSG", From: long}},
+		{"long transfer id", &binaryFrame{Type: "MSG", TransferID: long}},
+		{"long nonce", &binaryFrame{Type: "MSG", Nonce: []byte(long)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := encodeFrame(tt.f); err == nil {
+				t.Fatal("encodeFrame succeeded, want error")
+			}
+		})
+	}
+}
+
+func assertFrame(t *testing.T, got, want *binaryFrame) {
+	t.Helper()
+	if got.Type != want.Type || got.Seq != want.Seq || got.From != want.From ||
+		got.ClientID != want.ClientID || got.TransferID != want.TransferID {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if (got.Transfer == nil) != (want.Transfer == nil) ||
+		got.Transfer != nil && *got.Transfer != *want.Transfer {
+		t.Fatalf("transfer header: got %+v, want %+v", got.Transfer, want.Transfer)
+	}
+	if !bytes.Equal(got.Nonce, want.Nonce) || !bytes.Equal(got.Ciphertext, want.Ciphertext) {
+		t.Fatalf("nonce/ciphertext: got %x/%x, want %x/%x", got.Nonce, got.Ciphertext, want.Nonce, want.Ciphertext)
+	}
+}
@@ -0,0 +1,186 @@
+package httpx
+
+import (
+	"database/sql"
+	"encoding/json"
+	"sync"
+
+	"ephemeral/internal/rooms"
+	"ephemeral/internal/ws"
+)
+
+const (
+	defaultHistoryPage = 100
+	maxHistoryPage     = 500
+)
+
+// historyReplay streams a room's stored messages to one connection, one
+// page of rows at a time, between HISTORY_BEGIN and HISTORY_END.
+//
+// With a window of zero pages the replay streams continuously and is paced
+// only by the connection's send queue. Otherwise the client starts with
+// window pages of credit and grants more with HISTORY_MORE.
+type historyReplay struct {
+	db       *sql.DB
+	token    string
+	conn     *ws.Conn
+	afterSeq int
+	untilSeq int
+	pageSize int
+	flow     bool
+
+	mu      sync.Mutex // protects credits
+	credits int
+	more    chan struct{}
+}
+
+func newHistoryReplay(db *sql.DB, token string, conn *ws.Conn, afterSeq, untilSeq, pageSize, window int) *historyReplay {
+	if pageSize <= 0 {
+		pageSize = defaultHistoryPage
+	}
+	if pageSize > maxHistoryPage {
+		pageSize = maxHistoryPage
+	}
+	return &historyReplay{
+		db:       db,
+		token:    token,
+		conn:     conn,
+		afterSeq: afterSeq,
+		untilSeq: untilSeq,
+		pageSize: pageSize,
+		flow:     window > 0,
+		credits:  window,
+		more:     make(chan struct{}, 1),
+	}
+}
+
+// grant adds page credits from a HISTORY_MORE envelope.
+func (h *historyReplay) grant(pages int) {
+	if pages <= 0 {
+		pages = 1
+	}
+	h.mu.Lock()
+	h.credits += pages
+	h.mu.Unlock()
+
+	select {
+	case h.more <- struct{}{}:
+	default:
+	}
+}
+
+// take waits for one page of credit. It returns false if the connection
+// closed first.
+func (h *historyReplay) take() bool {
+	for {
+		h.mu.Lock()
+		if h.credits > 0 {
+			h.credits--
+			h.mu.Unlock()
+			return true
+		}
+		h.mu.Unlock()
+
+		select {
+		case <-h.more:
+		case <-h.conn.Done():
+			return false
+		}
+	}
+}
+
+func (h *historyReplay) run() error {
+	count, err := rooms.CountMessages(h.db, h.token, h.afterSeq, h.untilSeq)
+	if err != nil {
+		return err
+	}
+
+	begin, err := marshalEnvelope("HISTORY_BEGIN", map[string]interface{}{
+		"after_seq": h.afterSeq,
+		"until_seq": h.untilSeq,
+		"count":     count,
+		"page_size": h.pageSize,
+		"flow":      h.flow,
+	})
+	if err != nil {
+		return err
+	}
+	h.conn.EnqueueReliable(begin)
+
+	cursor, sent := h.afterSeq, 0
+	for sent < count {
+		if h.flow && !h.take() {
+			return nil
+		}
+
+		rows, err := rooms.GetMessagesPage(h.db, h.token, cursor, h.untilSeq, h.pageSize)
+		if err != nil {
+			return err
+		}
+		for _, row := range rows {
+			out, err := historyFrame(h.conn, row)
+			if err != nil {
+				return err
+			}
+			h.conn.EnqueueFrameReliable(out)
+		}
+
+		sent += len(rows)
+		if len(rows) < h.pageSize {
+			break
+		}
+		cursor = rows[len(rows)-1].Seq
+	}
+
+	end, err := marshalEnvelope("HISTORY_END", map[string]interface{}{
+		"count":    sent,
+		"last_seq": h.untilSeq,
+	})
+	if err != nil {
+		return err
+	}
+	h.conn.EnqueueReliable(end)
+	return nil
+}
+
+// historyFrame encodes a stored message for conn, as a binary frame if it
+// negotiated them and as a JSON envelope otherwise. Tombstones become
+// REDACTED envelopes.
+func historyFrame(conn *ws.Conn, row rooms.MessageRow) (ws.Frame, error) {
+	if row.RedactedAt != 0 {
+		payload, err := redactedEnvelope(row.Seq, row.TransferID, row.SenderID)
+		return ws.Frame{Data: payload}, err
+	}
+	f := &binaryFrame{
+		Type:       row.MessageType,
+		Seq:        row.Seq,
+		From:       row.SenderID,
+		TransferID: row.TransferID,
+		Nonce:      row.Nonce,
+		Ciphertext: row.Ciphertext,
+	}
+	if conn.Binary() {
+		if bin, err := encodeFrame(f); err == nil {
+			return ws.Frame{Binary: true, Data: bin}, nil
+		}
+	}
+	payload, err := textFrame(f)
+	if err != nil {
+		return ws.Frame{}, err
+	}
+	return ws.Frame{Data: payload}, nil
+}
+
+// redactedEnvelope tells clients to drop message seq (and, when tid is set,
+// the rest of that transfer).
+func redactedEnvelope(seq int, tid, from string) ([]byte, error) {
+	d := map[string]interface{}{"seq": seq}
+	if tid != "" {
+		d["tid"] = tid
+	}
+	return json.Marshal(map[string]interface{}{
+		"t":    "REDACTED",
+		"d":    d,
+		"from": from,
+	})
+}
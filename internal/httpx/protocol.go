@@ -0,0 +1,81 @@
+package httpx
+
+import (
+	"time"
+
+	"ephemeral/internal/config"
+	"ephemeral/internal/rooms"
+)
+
+// protocolVersion is the envelope version the server emits. Clients
+// declare theirs as "v" in READY and must pick one of supportedVersions.
+const protocolVersion = 1
+
+var supportedVersions = []int{1}
+
+// serverFeatures lists optional protocol capabilities, advertised in
+// WELCOME so clients can decide what to use.
+var serverFeatures = []string{
+	"ack",
+	"binary_frames",
+	"blobs",
+	"delete_on_delivery",
+	"expiry_warnings",
+	"extend",
+	"heartbeat",
+	"participants",
+	"presence",
+	"read_state",
+	"redact",
+	"relay_only",
+	"resumable_transfers",
+}
+
+// wsReadLimit is the largest single frame the server accepts.
+const wsReadLimit = 8 * 1024 * 1024
+
+func versionSupported(v int) bool {
+	for _, supported := range supportedVersions {
+		if v == supported {
+			return true
+		}
+	}
+	return false
+}
+
+// welcomePayload describes the server and the room to a newly connected
+// client. peerID is the client's own participant ID; peers are the other
+// participants online.
+func welcomePayload(cfg *config.Config, room *rooms.Room, latestSeq, participants int, peerID string, peers []string) map[string]interface{} {
+	state := expiryPayload(room.ExpiresAt)
+	state["latest_seq"] = latestSeq
+	state["participants"] = participants
+	state["peers"] = peers
+	state["max_participants"] = room.MaxParticipants
+	state["locked"] = room.Locked
+	state["delete_on_delivery"] = room.DeleteOnDelivery
+	state["persist"] = !room.RelayOnly
+	if deadline := room.IdleDeadline(); !deadline.IsZero() {
+		state["idle_expires_at"] = deadline.Format(time.RFC3339)
+	}
+
+	return map[string]interface{}{
+		"versions": supportedVersions,
+		"features": serverFeatures,
+		"limits": map[string]interface{}{
+			"max_frame_bytes":      wsReadLimit,
+			"max_image_bytes":      cfg.MaxImageBytes,
+			"transfer_timeout_sec": int64(cfg.TransferTimeout / time.Second),
+			"max_blob_bytes":       cfg.MaxBlobBytes,
+			"max_room_messages":    cfg.MaxRoomMessages,
+			"max_room_bytes":       cfg.MaxRoomBytes,
+			"conn_msg_rate":        cfg.ConnMessageRate,
+			"conn_byte_rate":       cfg.ConnByteRate,
+			"room_msg_rate":        cfg.RoomMessageRate,
+			"room_byte_rate":       cfg.RoomByteRate,
+			"rate_limit_strikes":   cfg.RateLimitStrikes,
+		},
+		"room":    state,
+		"peer_id": peerID,
+	}
+}
@@ -0,0 +1,231 @@
+package httpx
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"ephemeral/internal/config"
+	"ephemeral/internal/rooms"
+)
+
+// roomHandler serves /room/{token}: GET reports the expiry, DELETE destroys
+// the room and PATCH/POST extends its lifetime. /room/{token}/lock and
+// /room/{token}/kick manage access, and /room/{token}/blobs stores uploads.
+// Everything except GET and blobs requires the admin secret returned by
+// /create.
+func roomHandler(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, action, _ := strings.Cut(r.URL.Path[len("/room/"):], "/")
+		action, rest, _ := strings.Cut(action, "/")
+		if rest != "" && action != "blobs" {
+			http.NotFound(w, r)
+			return
+		}
+		if token == "" {
+			http.Error(w, "missing token", 400)
+			return
+		}
+
+		switch action {
+		case "":
+		case "lock":
+			lockRoom(w, r, db, token)
+			return
+		case "kick":
+			kickRoom(w, r, db, token)
+			return
+		case "blobs":
+			blobHandler(w, r, db, cfg, token, rest)
+			return
+		default:
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			room, err := rooms.Get(db, token)
+			if err != nil {
+				http.Error(w, "room not found or expired", 404)
+				return
+			}
+
+			info := expiryPayload(room.ExpiresAt)
+			info["max_participants"] = room.MaxParticipants
+			info["participants"] = liveParticipants(rooms.ID(token))
+			info["connections"] = connectionStats(rooms.ID(token))
+			info["locked"] = room.Locked
+			info["delete_on_delivery"] = room.DeleteOnDelivery
+			info["persist"] = !room.RelayOnly
+			info["usage"] = map[string]interface{}{
+				"messages":     room.MessageCount,
+				"bytes":        room.CiphertextBytes,
+				"max_messages": cfg.MaxRoomMessages,
+				"max_bytes":    cfg.MaxRoomBytes,
+			}
+			info["idle_timeout_sec"] = int64(room.IdleTimeout / time.Second)
+			if deadline := room.IdleDeadline(); !deadline.IsZero() {
+				info["idle_expires_at"] = deadline.Format(time.RFC3339)
+				info["idle_expires_in_sec"] = int(time.Until(deadline).Seconds())
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(info)
+
+		case http.MethodDelete:
+			if !requireAdmin(w, r, db, token) {
+				return
+			}
+
+			// Destroy room immediately
+			if err := rooms.Delete(db, token); err != nil {
+				log.Println("rooms.Delete failed:", err)
+				http.Error(w, "failed to delete room", 500)
+				return
+			}
+			DestroyRoom(rooms.ID(token), DestroyReasonDeleted)
+
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodPatch, http.MethodPost:
+			if !requireAdmin(w, r, db, token) {
+				return
+			}
+
+			var req struct {
+				ExtendBy json.RawMessage `json:"extend_by"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				writeJSONError(w, 400, "INVALID_REQUEST", "invalid JSON body")
+				return
+			}
+
+			by, err := parseDuration(req.ExtendBy)
+			if err != nil || by <= 0 {
+				writeJSONError(w, 400, "INVALID_DURATION", "extend_by must be a positive duration")
+				return
+			}
+
+			expires, err := extendRoom(db, cfg, token, by)
+			switch {
+			case errors.Is(err, rooms.ErrNotFound):
+				writeJSONError(w, 404, "ROOM_NOT_FOUND", "room not found or expired")
+				return
+			case errors.Is(err, rooms.ErrLifetimeExceeded):
+				writeJSONError(w, 409, "LIFETIME_EXCEEDED", "room maximum lifetime reached")
+				return
+			case err != nil:
+				log.Println("rooms.Extend failed:", err)
+				writeJSONError(w, 500, "SERVER_ERROR", "failed to extend room")
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(expiryPayload(expires))
+
+		default:
+			http.Error(w, "method not allowed", 405)
+		}
+	}
+}
+
+// lockRoom handles POST /room/{token}/lock with {"locked": bool}. A locked
+// room keeps its current connections but refuses new ones.
+func lockRoom(w http.ResponseWriter, r *http.Request, db *sql.DB, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !requireAdmin(w, r, db, token) {
+		return
+	}
+
+	var req struct {
+		Locked *bool `json:"locked"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Locked == nil {
+		writeJSONError(w, 400, "INVALID_REQUEST", "body must be {\"locked\": true|false}")
+		return
+	}
+
+	if err := rooms.SetLocked(db, token, *req.Locked); err != nil {
+		if errors.Is(err, rooms.ErrNotFound) {
+			writeJSONError(w, 404, "ROOM_NOT_FOUND", "room not found or expired")
+			return
+		}
+		log.Println("rooms.SetLocked failed:", err)
+		writeJSONError(w, 500, "SERVER_ERROR", "failed to lock room")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]bool{"locked": *req.Locked})
+}
+
+// kickRoom handles POST /room/{token}/kick and disconnects every live
+// connection. Combined with a lock this evicts anyone the link leaked to.
+func kickRoom(w http.ResponseWriter, r *http.Request, db *sql.DB, token string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	if !requireAdmin(w, r, db, token) {
+		return
+	}
+
+	kicked := KickRoom(rooms.ID(token))
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"kicked": kicked})
+}
+
+// requireAdmin checks the "Authorization: Bearer <admin secret>" header and
+// writes the error response when it does not match.
+func requireAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB, token string) bool {
+	secret, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || secret == "" {
+		writeJSONError(w, 401, "ADMIN_REQUIRED", "admin secret required")
+		return false
+	}
+
+	switch err := rooms.VerifyAdmin(db, token, strings.TrimSpace(secret)); {
+	case err == nil:
+		return true
+	case errors.Is(err, rooms.ErrNotFound):
+		writeJSONError(w, 404, "ROOM_NOT_FOUND", "room not found or expired")
+	case errors.Is(err, rooms.ErrForbidden):
+		writeJSONError(w, 403, "FORBIDDEN", "invalid admin secret")
+	default:
+		log.Println("rooms.VerifyAdmin failed:", err)
+		writeJSONError(w, 500, "SERVER_ERROR", "failed to verify admin secret")
+	}
+	return false
+}
+
+// extendRoom extends the room and tells connected peers about the new expiry
+// so their countdowns stay in sync.
+func extendRoom(db *sql.DB, cfg *config.Config, token string, by time.Duration) (time.Time, error) {
+	expires, err := rooms.Extend(db, token, by, cfg.MaxRoomLifetime)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if msg, err := marshalEnvelope("EXTENDED", expiryPayload(expires)); err == nil {
+		broadcastRoom(rooms.ID(token), msg)
+	}
+	rescheduleExpiry(rooms.ID(token), expires, cfg.ExpiryWarnings)
+
+	return expires, nil
+}
+
+func expiryPayload(expires time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"expires_at":     expires.Format(time.RFC3339),
+		"expires_in_sec": int(time.Until(expires).Seconds()),
+	}
+}
@@ -3,28 +3,79 @@ package httpx
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"ephemeral/internal/config"
 	"ephemeral/internal/rooms"
 )
 
-// parseTTL converts a string like "15m", "1h", "24h" to time.Duration
-func parseTTL(ttlStr string) (time.Duration, error) {
-	switch ttlStr {
-	case "15m":
-		return 15 * time.Minute, nil
-	case "1h":
-		return 1 * time.Hour, nil
-	case "24h":
-		return 24 * time.Hour, nil
-	default:
-		return 1 * time.Hour, nil // default to 1 hour
+// parseDuration accepts either a Go duration string ("90m", "1h30m"), a
+// string of whole seconds ("5400") or a JSON number of seconds (5400).
+// A missing or null value returns 0 with no error.
+func parseDuration(raw json.RawMessage) (time.Duration, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 0, nil
 	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		if d, err := time.ParseDuration(str); err == nil {
+			return d, nil
+		}
+		secs, err := strconv.ParseInt(str, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", str)
+		}
+		return secondsDuration(secs)
+	}
+
+	var secs int64
+	if err := json.Unmarshal(raw, &secs); err != nil {
+		return 0, fmt.Errorf("duration must be a string or whole seconds")
+	}
+	return secondsDuration(secs)
+}
+
+// maxDurationSeconds is the most whole seconds a time.Duration can hold.
+const maxDurationSeconds = math.MaxInt64 / int64(time.Second)
+
+// secondsDuration converts whole seconds to a duration, refusing counts
+// that would overflow instead of wrapping around to a short one.
+func secondsDuration(secs int64) (time.Duration, error) {
+	if secs > maxDurationSeconds || secs < -maxDurationSeconds {
+		return 0, fmt.Errorf("duration of %d seconds is too long", secs)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// writeJSONError responds with the same {code, message} shape used by
+// websocket ERROR envelopes.
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"code":    code,
+		"message": message,
+	})
+}
+
+// durationSeconds converts durations to whole seconds for JSON responses
+func durationSeconds(list []time.Duration) []int64 {
+	secs := make([]int64, 0, len(list))
+	for _, d := range list {
+		secs = append(secs, int64(d/time.Second))
+	}
+	return secs
 }
 
-func Router(db *sql.DB) http.Handler {
+func Router(db *sql.DB, cfg *config.Config) http.Handler {
 	mux := http.NewServeMux()
 
 	// create room with TTL
@@ -35,16 +86,69 @@ func Router(db *sql.DB) http.Handler {
 		}
 
 		var req struct {
-			TTL string `json:"ttl"`
+			TTL              json.RawMessage `json:"ttl"`
+			MaxParticipants  int             `json:"max_participants"`
+			IdleTimeout      json.RawMessage `json:"idle_timeout"`
+			DeleteOnDelivery bool            `json:"delete_on_delivery"`
+			Persist          *bool           `json:"persist"`
+		}
+
+		// An empty body is allowed and means "use the defaults"
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			writeJSONError(w, 400, "INVALID_REQUEST", "invalid JSON body")
+			return
+		}
+
+		ttl := cfg.DefaultTTL
+		if len(req.TTL) > 0 && string(req.TTL) != "null" {
+			parsed, err := parseDuration(req.TTL)
+			if err != nil {
+				writeJSONError(w, 400, "INVALID_TTL", err.Error())
+				return
+			}
+			ttl = parsed
+		}
+		if err := cfg.CheckTTL(ttl); err != nil {
+			writeJSONError(w, 400, "INVALID_TTL", err.Error())
+			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			req.TTL = "1h" // default
+		maxParticipants := cfg.DefaultParticipants
+		if req.MaxParticipants != 0 {
+			maxParticipants = req.MaxParticipants
+		}
+		if maxParticipants < 1 || maxParticipants > cfg.MaxParticipants {
+			writeJSONError(w, 400, "INVALID_PARTICIPANTS",
+				fmt.Sprintf("max_participants must be between 1 and %d", cfg.MaxParticipants))
+			return
 		}
 
-		ttl, _ := parseTTL(req.TTL)
+		// Idle timeout is optional; when set it must fit inside the TTL
+		idleTimeout, err := parseDuration(req.IdleTimeout)
+		if err != nil {
+			writeJSONError(w, 400, "INVALID_IDLE_TIMEOUT", err.Error())
+			return
+		}
+		if idleTimeout != 0 && (idleTimeout < cfg.MinTTL || idleTimeout >= ttl) {
+			writeJSONError(w, 400, "INVALID_IDLE_TIMEOUT",
+				fmt.Sprintf("idle_timeout must be at least %s and shorter than the ttl", cfg.MinTTL))
+			return
+		}
+
+		// Rooms persist messages unless asked not to
+		relayOnly := req.Persist != nil && !*req.Persist
+		if relayOnly && req.DeleteOnDelivery {
+			writeJSONError(w, 400, "INVALID_REQUEST", "delete_on_delivery requires a persistent room")
+			return
+		}
 
-		token, expires, err := rooms.Create(db, ttl)
+		token, adminSecret, expires, err := rooms.Create(db, rooms.Options{
+			TTL:              ttl,
+			MaxParticipants:  maxParticipants,
+			IdleTimeout:      idleTimeout,
+			DeleteOnDelivery: req.DeleteOnDelivery,
+			RelayOnly:        relayOnly,
+		})
 		if err != nil {
 			log.Println("rooms.Create failed:", err)
 			http.Error(w, "server error", 500)
@@ -52,51 +156,42 @@ func Router(db *sql.DB) http.Handler {
 		}
 
 		w.Header().Set("Content-Type", "application/json")
+		// The admin secret is only ever returned here
 		_ = json.NewEncoder(w).Encode(map[string]string{
-			"url":        "/#" + token,
-			"expires_at": expires.Format(time.RFC3339),
+			"url":          "/#" + token,
+			"admin_secret": adminSecret,
+			"expires_at":   expires.Format(time.RFC3339),
 		})
 	})
 
-	// get room expiry
-	mux.HandleFunc("/room/", func(w http.ResponseWriter, r *http.Request) {
-		token := r.URL.Path[len("/room/"):]
-		if token == "" {
-			http.Error(w, "missing token", 400)
+	// publish room policy so the create page can render valid choices
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", 405)
 			return
 		}
 
-		switch r.Method {
-		case http.MethodGet:
-			expires, err := rooms.GetExpiry(db, token)
-			if err != nil {
-				http.Error(w, "room not found or expired", 404)
-				return
-			}
-
-			w.Header().Set("Content-Type", "application/json")
-			_ = json.NewEncoder(w).Encode(map[string]interface{}{
-				"expires_at":     expires.Format(time.RFC3339),
-				"expires_in_sec": int(time.Until(expires).Seconds()),
-			})
-
-		case http.MethodDelete:
-			// Destroy room immediately
-			if err := rooms.Delete(db, token); err != nil {
-				log.Println("rooms.Delete failed:", err)
-				http.Error(w, "failed to delete room", 500)
-				return
-			}
-
-			w.WriteHeader(http.StatusNoContent)
-
-		default:
-			http.Error(w, "method not allowed", 405)
-		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"ttl": map[string]interface{}{
+				"min_sec":     int64(cfg.MinTTL / time.Second),
+				"max_sec":     int64(cfg.MaxTTL / time.Second),
+				"default_sec": int64(cfg.DefaultTTL / time.Second),
+				"allowed_sec": durationSeconds(cfg.AllowedTTLs),
+			},
+			"max_room_lifetime_sec": int64(cfg.MaxRoomLifetime / time.Second),
+			"participants": map[string]int{
+				"max":     cfg.MaxParticipants,
+				"default": cfg.DefaultParticipants,
+			},
+		})
 	})
 
+	// room expiry, extension and destruction
+	mux.HandleFunc("/room/", roomHandler(db, cfg))
+
 	// websocket rooms
-	mux.Handle("/ws/", wsHandler(db))
+	mux.Handle("/ws/", wsHandler(db, cfg))
 
 	// Create room page
 	mux.HandleFunc("/create-room", func(w http.ResponseWriter, r *http.Request) {
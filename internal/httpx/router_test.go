@@ -0,0 +1,47 @@
+package httpx
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		raw      string
+		want     time.Duration
+		wantFail bool
+	}{
+		{raw: ``, want: 0},
+		{raw: `null`, want: 0},
+		{raw: `"90m"`, want: 90 * time.Minute},
+		{raw: `"1h30m"`, want: 90 * time.Minute},
+		{raw: `"5400"`, want: 90 * time.Minute},
+		{raw: `5400`, want: 90 * time.Minute},
+		{raw: `-60`, want: -time.Minute},
+		{raw: `9223372036`, want: 9223372036 * time.Second},
+		{raw: `"soon"`, wantFail: true},
+		{raw: `1.5`, wantFail: true},
+		{raw: `true`, wantFail: true},
+
+		// Seconds past what a Duration holds used to wrap around, this
+		// one to a single hour
+		{raw: `9223372037`, wantFail: true},
+		{raw: `18446747674`, wantFail: true},
+		{raw: `"18446747674"`, wantFail: true},
+		{raw: `-18446747674`, wantFail: true},
+		{raw: `"99999999999h"`, wantFail: true},
+	}
+	for _, tt := range tests {
+		got, err := parseDuration(json.RawMessage(tt.raw))
+		if tt.wantFail {
+			if err == nil {
+				t.Errorf("parseDuration(%s) = %v, want error", tt.raw, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseDuration(%s) = %v, %v; want %v", tt.raw, got, err, tt.want)
+		}
+	}
+}
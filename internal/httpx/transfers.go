@@ -0,0 +1,74 @@
+package httpx
+
+import (
+	"errors"
+	"fmt"
+
+	"ephemeral/internal/config"
+	"ephemeral/internal/rooms"
+	"ephemeral/internal/ws"
+)
+
+// maxTransferChunks caps the chunk count a transfer header may declare,
+// which bounds the server's bitmap of received chunks.
+const maxTransferChunks = 1 << 16
+
+// transferFields are the optional plaintext transfer header of JSON
+// IMG_META (size, chunks) and IMG_CHUNK (i) envelopes.
+type transferFields struct {
+	Size   *int64 `json:"size"`
+	Chunks *int   `json:"chunks"`
+	Index  *int   `json:"i"`
+}
+
+// header returns the transfer header for a message of type t, or nil if
+// the client did not send one.
+func (tf transferFields) header(t string) *rooms.TransferHeader {
+	switch {
+	case t == rooms.TransferStart && tf.Size != nil && tf.Chunks != nil:
+		return &rooms.TransferHeader{Size: *tf.Size, Chunks: *tf.Chunks}
+	case t == rooms.TransferChunk && tf.Index != nil:
+		return &rooms.TransferHeader{Index: *tf.Index}
+	}
+	return nil
+}
+
+// checkTransferHeader validates the size and chunk count a transfer
+// declares when it starts.
+func checkTransferHeader(cfg *config.Config, t string, h *rooms.TransferHeader) error {
+	if h == nil || t != rooms.TransferStart {
+		return nil
+	}
+	if h.Size <= 0 || h.Size > cfg.MaxImageBytes {
+		return fmt.Errorf("transfer size must be between 1 and %d bytes", cfg.MaxImageBytes)
+	}
+	if h.Chunks < 1 || h.Chunks > maxTransferChunks || int64(h.Chunks) > h.Size {
+		return errors.New("invalid transfer chunk count")
+	}
+	return nil
+}
+
+// sendTransferState tells a reconnecting sender which chunks of its
+// unfinished transfers the server already has, so it can resume them.
+func sendTransferState(conn *ws.Conn, transfers []rooms.Transfer) {
+	for _, t := range transfers {
+		msg, err := marshalEnvelope("TRANSFER_STATE", map[string]interface{}{
+			"tid":      t.ID,
+			"size":     t.Size,
+			"chunks":   t.Chunks,
+			"received": t.Received,
+		})
+		if err != nil {
+			continue
+		}
+		conn.EnqueueControl(msg)
+	}
+}
+
+// AbortTransfer tells a room that the server deleted an incomplete
+// transfer after it went too long without a chunk.
+func AbortTransfer(roomID, transferID string) {
+	if msg, err := marshalEnvelope("TRANSFER_ABORTED", map[string]string{"tid": transferID}); err == nil {
+		broadcastRoom(roomID, msg)
+	}
+}
@@ -0,0 +1,81 @@
+package httpx
+
+import (
+	"log"
+
+	"ephemeral/internal/config"
+)
+
+// typePolicy says how the server treats one websocket envelope type.
+type typePolicy struct {
+	// Persist stores the {n, c} payload for history replay (assigning a seq)
+	Persist bool
+	// Relay forwards the envelope to the other connections in the room
+	Relay bool
+	// MaxPayload caps the size of "d" in bytes; 0 leaves only the frame limit
+	MaxPayload int
+	// BeforeHandshake allows the type before the client's READY
+	BeforeHandshake bool
+	// serverHandled types are consumed by wsHandler itself
+	serverHandled bool
+}
+
+// typeRegistry maps envelope types to their policy. Types missing from it
+// are rejected with UNKNOWN_TYPE.
+type typeRegistry map[string]typePolicy
+
+const maxEncryptedPayload = 128 * 1024 // matches the client's frame cap
+
+var builtinTypes = typeRegistry{
+	"HELLO":        {Relay: true, MaxPayload: 1024, BeforeHandshake: true},
+	"READY":        {MaxPayload: 1024, BeforeHandshake: true, serverHandled: true},
+	"EXTEND":       {MaxPayload: 1024, BeforeHandshake: true, serverHandled: true},
+	"HISTORY_MORE": {MaxPayload: 256, serverHandled: true},
+	"READ":         {MaxPayload: 256, serverHandled: true},
+	"REDACT":       {MaxPayload: 256, serverHandled: true},
+	"DELIVERED":    {MaxPayload: 256, serverHandled: true},
+	"CHAT":         {Relay: true, MaxPayload: 16 * 1024, BeforeHandshake: true},
+	"MSG":          {Persist: true, Relay: true, MaxPayload: maxEncryptedPayload},
+	"IMG_META":     {Persist: true, Relay: true, MaxPayload: maxEncryptedPayload},
+	"IMG_CHUNK":    {Persist: true, Relay: true, MaxPayload: maxEncryptedPayload},
+	"IMG_END":      {Persist: true, Relay: true, MaxPayload: maxEncryptedPayload},
+}
+
+// newTypeRegistry returns the built-in types plus those from config.
+// Configured types may override built-in relay/persist types but not the
+// ones the server handles itself.
+func newTypeRegistry(extra []config.MessageType) typeRegistry {
+	reg := make(typeRegistry, len(builtinTypes)+len(extra))
+	for name, policy := range builtinTypes {
+		reg[name] = policy
+	}
+	for _, mt := range extra {
+		if reg[mt.Name].serverHandled {
+			log.Printf("ignoring EPHEMERAL_MESSAGE_TYPES entry for server-handled type %s", mt.Name)
+			continue
+		}
+		reg[mt.Name] = typePolicy{
+			Persist:         mt.Persist,
+			Relay:           mt.Relay,
+			MaxPayload:      mt.MaxPayload,
+			BeforeHandshake: mt.BeforeHandshake,
+		}
+	}
+	return reg
+}
+
+// check returns the policy for t, or a protocol error code and message
+// when the envelope must be rejected.
+func (reg typeRegistry) check(t string, payloadSize int, handshaken bool) (typePolicy, string, string) {
+	policy, ok := reg[t]
+	if !ok {
+		return policy, "UNKNOWN_TYPE", "unknown message type"
+	}
+	if policy.MaxPayload > 0 && payloadSize > policy.MaxPayload {
+		return policy, "PAYLOAD_TOO_LARGE", "payload exceeds the limit for this type"
+	}
+	if !policy.BeforeHandshake && !handshaken {
+		return policy, "HANDSHAKE_REQUIRED", "send READY first"
+	}
+	return policy, "", ""
+}
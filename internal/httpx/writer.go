@@ -0,0 +1,65 @@
+package httpx
+
+import "ephemeral/internal/ws"
+
+// writeLoop drains conn's queues through write until conn is closed or a
+// write fails. Control frames always go first. On close it flushes what is
+// still queued (skipping room traffic when the queue itself is why conn
+// was closed) and the close message, then returns nil so the caller can
+// send the close frame.
+func writeLoop(conn *ws.Conn, write func(ws.Frame) error) error {
+	for {
+		select {
+		case f := <-conn.Control():
+			if err := write(f); err != nil {
+				return err
+			}
+			continue
+		default:
+		}
+
+		select {
+		case f := <-conn.Control():
+			if err := write(f); err != nil {
+				return err
+			}
+		case f, ok := <-conn.Send():
+			if !ok {
+				return nil
+			}
+			if err := write(f); err != nil {
+				return err
+			}
+		case <-conn.Done():
+			return flushQueues(conn, write)
+		}
+	}
+}
+
+func flushQueues(conn *ws.Conn, write func(ws.Frame) error) error {
+	code, _ := conn.CloseStatus()
+	lanes := []<-chan ws.Frame{conn.Control()}
+	if code != int(closeLagging) {
+		lanes = append(lanes, conn.Send())
+	}
+	for _, lane := range lanes {
+		for flushed := false; !flushed; {
+			select {
+			case f, ok := <-lane:
+				if !ok {
+					flushed = true
+					break
+				}
+				if err := write(f); err != nil {
+					return err
+				}
+			default:
+				flushed = true
+			}
+		}
+	}
+	if msg := conn.CloseMessage(); msg != nil {
+		return write(ws.Frame{Data: msg})
+	}
+	return nil
+}
@@ -1,15 +1,19 @@
 package httpx
 
 import (
+	"context"
 	"database/sql"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"ephemeral/internal/config"
+	"ephemeral/internal/ratelimit"
 	"ephemeral/internal/rooms"
 	"ephemeral/internal/ws"
 	"sync"
@@ -23,28 +27,200 @@ import (
 type Envelope struct {
 	Type    string          `json:"t"`
 	Payload json.RawMessage `json:"d"`
+	// From is stamped by the server on relayed envelopes; whatever the
+	// client put there is overwritten
+	From string `json:"from,omitempty"`
+}
+
+// marshalEnvelope builds a server-originated envelope.
+func marshalEnvelope(t string, d interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"t": t,
+		"d": d,
+	})
 }
 
 type roomHub struct {
-	mu      sync.Mutex // protects lastSeq
-	hub     *ws.Hub
-	count   int
-	lastSeq int
+	mu              sync.Mutex // protects timers and timerGen
+	order           sync.Mutex // serializes storing and relaying persisted messages
+	hub             *ws.Hub
+	limiter         *ratelimit.Limiter // inbound traffic from all connections
+	count           int                // connections; protected by hubsMu
+	participants    map[string]int     // devices per participant; protected by hubsMu
+	maxParticipants int
+	timers          []*time.Timer
+	timerGen        int
 }
 
-func (rh *roomHub) NextSeq() int {
-	rh.mu.Lock()
-	defer rh.mu.Unlock()
-	rh.lastSeq++
-	return rh.lastSeq
+// latestSeq returns the last stored seq. Taken under order, so every
+// message up to it has also been relayed to the room's connections.
+func (rh *roomHub) latestSeq(db *sql.DB, token string) (int, error) {
+	rh.order.Lock()
+	defer rh.order.Unlock()
+	return rooms.LatestSeq(db, token)
 }
 
+// hubs is keyed by room ID (rooms.ID), never by the token itself.
 var (
 	hubs   = make(map[string]*roomHub)
 	hubsMu sync.Mutex // protects hubs map
 )
 
-func wsHandler(db *sql.DB) http.HandlerFunc {
+// Websocket close codes sent by the server (4000-4999 is the
+// application-defined range).
+const (
+	closeRoomDestroyed websocket.StatusCode = 4001
+	closeKicked        websocket.StatusCode = 4002
+	closeUnsupported   websocket.StatusCode = 4003
+	closeLagging       websocket.StatusCode = 4004
+	closeRateLimited   websocket.StatusCode = 4005
+)
+
+// Clients offer wsSubprotocol and, when they have a device key, a second
+// subprotocol carrying it, so the key never appears in a URL or access log.
+const (
+	wsSubprotocol        = "ephemeral"
+	participantKeyPrefix = "ephemeral.pk."
+)
+
+// offeredParticipantKey returns the device key from the request's
+// Sec-WebSocket-Protocol offers, or "" if none carries one.
+func offeredParticipantKey(r *http.Request) string {
+	for _, h := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(h, ",") {
+			if key, ok := strings.CutPrefix(strings.TrimSpace(p), participantKeyPrefix); ok {
+				return key
+			}
+		}
+	}
+	return ""
+}
+
+// Reasons carried by ROOM_DESTROYED envelopes.
+const (
+	DestroyReasonDeleted = "deleted"
+	DestroyReasonExpired = rooms.ReasonExpired
+	DestroyReasonIdle    = rooms.ReasonIdle
+)
+
+// DestroyRoom tells every live connection in the room that it is gone,
+// closes them and drops the in-memory hub. It is a no-op for rooms
+// without connections.
+func DestroyRoom(roomID, reason string) {
+	hubsMu.Lock()
+	rh := hubs[roomID]
+	delete(hubs, roomID)
+	hubsMu.Unlock()
+
+	if rh == nil {
+		return
+	}
+	rh.stopExpiry()
+
+	// Expiry has its own envelope type; everything else is ROOM_DESTROYED
+	t := "ROOM_DESTROYED"
+	if reason == DestroyReasonExpired {
+		t = "ROOM_EXPIRED"
+	}
+	msg, err := marshalEnvelope(t, map[string]string{
+		"reason": reason,
+	})
+	if err != nil {
+		return
+	}
+	rh.hub.CloseAll(msg, int(closeRoomDestroyed), "room "+reason)
+}
+
+// KickRoom disconnects every live connection in the room and returns how
+// many were closed. The room itself stays intact.
+func KickRoom(roomID string) int {
+	hubsMu.Lock()
+	rh := hubs[roomID]
+	hubsMu.Unlock()
+
+	if rh == nil {
+		return 0
+	}
+
+	msg, err := marshalEnvelope("KICKED", map[string]string{})
+	if err != nil {
+		return 0
+	}
+	return rh.hub.CloseAll(msg, int(closeKicked), "kicked by room admin")
+}
+
+// liveParticipants returns the number of participants connected to the
+// room, counting each person once however many devices they use.
+func liveParticipants(roomID string) int {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+
+	if rh := hubs[roomID]; rh != nil {
+		return len(rh.participants)
+	}
+	return 0
+}
+
+// LiveRooms returns the IDs of rooms with at least one live connection,
+// each with the IDs of its connected participants.
+func LiveRooms() map[string][]string {
+	hubsMu.Lock()
+	defer hubsMu.Unlock()
+
+	live := make(map[string][]string, len(hubs))
+	for roomID, rh := range hubs {
+		if rh.count == 0 {
+			continue
+		}
+		participants := make([]string, 0, len(rh.participants))
+		for participant := range rh.participants {
+			participants = append(participants, participant)
+		}
+		live[roomID] = participants
+	}
+	return live
+}
+
+// connectionStats returns queue and drop statistics for each live
+// connection in the room.
+func connectionStats(roomID string) []ws.Stats {
+	hubsMu.Lock()
+	rh := hubs[roomID]
+	hubsMu.Unlock()
+
+	if rh == nil {
+		return []ws.Stats{}
+	}
+	return rh.hub.Stats()
+}
+
+// announcePresence tells everyone else in the room that participant came
+// online with their first device (PEER_JOINED) or went offline with their
+// last (PEER_LEFT).
+func announcePresence(rh *roomHub, participant, t string) {
+	msg, err := marshalEnvelope(t, map[string]string{
+		"peer": participant,
+	})
+	if err != nil {
+		return
+	}
+	rh.hub.BroadcastExceptParticipant(msg, participant)
+}
+
+// broadcastRoom delivers msg to every live connection in the room, if any.
+func broadcastRoom(roomID string, msg []byte) {
+	hubsMu.Lock()
+	rh := hubs[roomID]
+	hubsMu.Unlock()
+
+	if rh != nil {
+		rh.hub.BroadcastControl(msg, nil)
+	}
+}
+
+func wsHandler(db *sql.DB, cfg *config.Config) http.HandlerFunc {
+	types := newTypeRegistry(cfg.MessageTypes)
+
 	return func(w http.ResponseWriter, r *http.Request) {
 		token := strings.TrimPrefix(r.URL.Path, "/ws/")
 		if token == "" {
@@ -53,44 +229,136 @@ func wsHandler(db *sql.DB) http.HandlerFunc {
 		}
 
 		// Check room still exists & not expired
-		ok, err := rooms.Exists(db, token)
-		if err != nil || !ok {
+		room, err := rooms.Get(db, token)
+		if err != nil {
 			http.Error(w, "room expired", http.StatusNotFound)
 			return
 		}
 
-		// Get or create hub (protected by mutex)
+		// Locked rooms keep existing connections but refuse new ones
+		if room.Locked {
+			http.Error(w, "room locked", http.StatusForbidden)
+			return
+		}
+
+		// Devices presenting the same key are one participant. Clients
+		// without a key get one in WELCOME to reuse on their other devices.
+		if r.URL.Query().Has("pk") {
+			http.Error(w, "participant key must be sent as a subprotocol, not in the URL", http.StatusBadRequest)
+			return
+		}
+		participantKey, issuedKey := offeredParticipantKey(r), ""
+		if participantKey == "" {
+			participantKey = rooms.NewParticipantKey()
+			issuedKey = participantKey
+		} else if !rooms.ValidParticipantKey(participantKey) {
+			http.Error(w, "invalid participant key", http.StatusBadRequest)
+			return
+		}
+		participant := rooms.ParticipantID(token, participantKey)
+
+		// Get or create hub and reserve a participant slot (protected by mutex).
+		// Further devices of a participant already here take no extra slot.
+		roomID := rooms.ID(token)
 		hubsMu.Lock()
-		rh := hubs[token]
+		rh := hubs[roomID]
 		if rh == nil {
-			maxSeq, _ := rooms.GetMaxSeq(db, token)
 			rh = &roomHub{
-				hub:     ws.NewHub(),
-				lastSeq: maxSeq,
+				hub:             ws.NewHub(),
+				limiter:         ratelimit.New(cfg.RoomMessageRate, cfg.RoomByteRate),
+				participants:    make(map[string]int),
+				maxParticipants: room.MaxParticipants,
 			}
-			hubs[token] = rh
+			hubs[roomID] = rh
+			rh.scheduleExpiry(roomID, room.ExpiresAt, cfg.ExpiryWarnings)
 		}
-		hubsMu.Unlock()
-
-		// Enforce max 2 participants
-		if rh.count >= 2 {
+		if rh.participants[participant] == 0 && len(rh.participants) >= rh.maxParticipants {
+			hubsMu.Unlock()
 			http.Error(w, "room full", http.StatusForbidden)
 			return
 		}
+		rh.count++
+		rh.participants[participant]++
+		firstDevice := rh.participants[participant] == 1
+		hubsMu.Unlock()
+
+		announced := false
+		defer func() {
+			hubsMu.Lock()
+			rh.count--
+			rh.participants[participant]--
+			lastDevice := rh.participants[participant] == 0
+			if lastDevice {
+				delete(rh.participants, participant)
+			}
+
+			// Clean up in-memory hub when last client disconnects
+			// (Room persists in DB for history replay until expiry).
+			// DestroyRoom may already have replaced or removed it.
+			if rh.count == 0 && hubs[roomID] == rh {
+				delete(hubs, roomID)
+				rh.stopExpiry()
+			}
+			hubsMu.Unlock()
+
+			if announced && lastDevice {
+				announcePresence(rh, participant, "PEER_LEFT")
+			}
+		}()
 
 		wsconn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+			Subprotocols:    []string{wsSubprotocol},
 			CompressionMode: websocket.CompressionDisabled,
 		})
 		if err != nil {
 			return
 		}
-		// Set read limit to 10MB to handle large encrypted image chunks
-		wsconn.SetReadLimit(8 * 1024 * 1024) // 10 MB
+		// Large enough for encrypted image chunks
+		wsconn.SetReadLimit(wsReadLimit)
 		defer wsconn.Close(websocket.StatusNormalClosure, "")
 
-		conn := ws.NewConn()
-		rh.count++
+		conn := ws.NewConn(participant)
+
+		// --- slow consumers: what happens when conn's queue overflows ---
+		// Set before hub.Add publishes conn to peers' broadcasts. Only
+		// persisted frames can be re-read from the database; losing anything
+		// else (control frames, relay-only messages) closes the connection
+		// under either policy.
+		lagged := make(chan int, 1)
+		conn.SetOverflowHandler(func(f ws.Frame) {
+			if f.Seq > 0 && cfg.SlowConsumerPolicy == config.SlowConsumerCatchUp {
+				// Catch up starting just before the first miss
+				if conn.StartLagging() {
+					lagged <- f.Seq - 1
+				}
+				return
+			}
+			conn.Close(int(closeLagging), "lagging")
+		})
+
+		peers := []string{}
+		for _, id := range rh.hub.Participants() {
+			if id != participant {
+				peers = append(peers, id)
+			}
+		}
 		rh.hub.Add(conn)
+		defer rh.hub.Remove(conn)
+
+		// Let the other participants know who is online
+		if firstDevice {
+			announcePresence(rh, participant, "PEER_JOINED")
+		}
+		announced = true
+
+		readSeq, deliveredSeq, err := rooms.JoinParticipant(db, token, participant)
+		if err != nil {
+			log.Println("JoinParticipant failed:", err)
+		}
+
+		// Connecting and disconnecting both count as room activity
+		_ = rooms.Touch(db, token)
+		defer rooms.Touch(db, token)
 
 		lastSeenSeq := 0
 		if after := r.URL.Query().Get("after_seq"); after != "" {
@@ -104,75 +372,109 @@ func wsHandler(db *sql.DB) http.HandlerFunc {
 			}
 		}
 
-		defer func() {
-			rh.hub.Remove(conn)
-			hubsMu.Lock()
-			rh.count--
-
-			// Clean up in-memory hub when last client disconnects
-			// (Room persists in DB for history replay until expiry)
-			if rh.count == 0 {
-				delete(hubs, token)
+		// --- writer loop (server → client) ---
+		// The only goroutine that writes frames to wsconn. Every write has a
+		// deadline, and the first failure tears the connection down: the
+		// reader loop unblocks and the handler cleans up.
+		write := func(f ws.Frame) error {
+			typ := websocket.MessageText
+			if f.Binary {
+				typ = websocket.MessageBinary
 			}
-			hubsMu.Unlock()
+			ctx, cancel := context.WithTimeout(r.Context(), cfg.WriteTimeout)
+			defer cancel()
+			return wsconn.Write(ctx, typ, f.Data)
+		}
+		writerDone := make(chan struct{})
+		go func() {
+			defer close(writerDone)
+			err := writeLoop(conn, write)
+			if err == nil {
+				code, reason := conn.CloseStatus()
+				_ = wsconn.Close(websocket.StatusCode(code), reason)
+				return
+			}
+			log.Printf("write to connection %s failed: %v\n", conn.ID(), err)
+			conn.Close(int(websocket.StatusAbnormalClosure), "write failed")
+			_ = wsconn.CloseNow()
+		}()
+		// Let the writer flush and send the close frame before the queues
+		// are torn down
+		defer func() {
+			conn.Close(int(websocket.StatusNormalClosure), "")
+			<-writerDone
 		}()
 
-		// --- writer loop (server → client) ---
+		// --- heartbeat: evict connections that stop answering pings ---
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
 		go func() {
-			for msg := range conn.Send() {
-				_ = wsconn.Write(r.Context(), websocket.MessageText, msg)
+			ticker := time.NewTicker(cfg.PingInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					pingCtx, cancelPing := context.WithTimeout(ctx, cfg.PingTimeout)
+					err := wsconn.Ping(pingCtx)
+					cancelPing()
+					if err != nil {
+						// Unblocks the reader loop, which releases the slot
+						_ = wsconn.CloseNow()
+						return
+					}
+				}
 			}
 		}()
 
-		historySent := false
-		sendHistory := func() error {
-			if historySent {
-				return nil
-			}
+		// Introduce the server and room before anything else is sent
+		latestSeq, _ := rh.latestSeq(db, token)
+		welcome := welcomePayload(cfg, room, latestSeq, liveParticipants(roomID), participant, peers)
+		welcome["device_id"] = conn.ID()
+		welcome["read_seq"] = readSeq
+		welcome["delivered_seq"] = deliveredSeq
+		if issuedKey != "" {
+			welcome["participant_key"] = issuedKey
+		}
+		if msg, err := marshalEnvelope("WELCOME", welcome); err == nil {
+			conn.EnqueueControl(msg)
+		}
 
-			rows, err := rooms.GetMessagesSince(db, token, lastSeenSeq)
-			if err != nil {
-				return err
-			}
-
-			for _, row := range rows {
-				envelope := struct {
-					Type string `json:"t"`
-					Data struct {
-						Version    int    `json:"v"`
-						Seq        int    `json:"seq"`
-						Nonce      string `json:"n"`
-						Ciphertext string `json:"c"`
-					} `json:"d"`
-				}{
-					Type: row.MessageType,
-					Data: struct {
-						Version    int    `json:"v"`
-						Seq        int    `json:"seq"`
-						Nonce      string `json:"n"`
-						Ciphertext string `json:"c"`
-					}{
-						Version:    1,
-						Seq:        row.Seq,
-						Nonce:      base64.RawURLEncoding.EncodeToString(row.Nonce),
-						Ciphertext: base64.RawURLEncoding.EncodeToString(row.Ciphertext),
-					},
-				}
-
-				payload, err := json.Marshal(envelope)
-				if err != nil {
-					return err
+		handshaken := false
+
+		// History replay and catch-up run beside the reader loop. They have
+		// to stop before hub.Remove closes the send queue, hence closing the
+		// connection and waiting for them on exit.
+		var replay *historyReplay
+		var workers sync.WaitGroup
+		defer workers.Wait()
+		defer conn.Close(int(websocket.StatusNormalClosure), "")
+
+		var ownSeqs sync.Map // seqs conn sent while lagging; not fed back to it
+		if cfg.SlowConsumerPolicy == config.SlowConsumerCatchUp {
+			workers.Add(1)
+			go func() {
+				defer workers.Done()
+				for {
+					select {
+					case after := <-lagged:
+						if err := rh.catchUp(db, token, conn, after, &ownSeqs); err != nil {
+							log.Println("catch-up failed:", err)
+							conn.Close(int(closeLagging), "lagging")
+							return
+						}
+					case <-conn.Done():
+						return
+					}
 				}
-				conn.EnqueueReliable(payload)
-
-				// Pace history replay to avoid overwhelming the client socket
-				// and triggering disconnects or buffer overflows.
-				time.Sleep(5 * time.Millisecond)
-			}
-
-			historySent = true
-			return nil
+			}()
 		}
+		defer func() {
+			if n := conn.Dropped(); n > 0 {
+				log.Printf("connection %s dropped %d frames\n", conn.ID(), n)
+			}
+		}()
 
 		sendProtocolError := func(code, message string) {
 			payload, err := json.Marshal(map[string]interface{}{
@@ -185,22 +487,190 @@ func wsHandler(db *sql.DB) http.HandlerFunc {
 			if err != nil {
 				return
 			}
-			_ = wsconn.Write(r.Context(), websocket.MessageText, payload)
+			conn.EnqueueControl(payload)
+		}
+		// sendMessageError rejects one of the client's messages, echoing
+		// its id (if it gave one) like ACK does
+		sendMessageError := func(clientID, code, message string) {
+			if clientID == "" {
+				sendProtocolError(code, message)
+				return
+			}
+			if payload, err := marshalEnvelope("ERROR", map[string]string{
+				"id":      clientID,
+				"code":    code,
+				"message": message,
+			}); err == nil {
+				conn.EnqueueControl(payload)
+			}
+		}
+
+		// --- inbound rate limits, charged per frame to conn and the room ---
+		limiter := ratelimit.New(cfg.ConnMessageRate, cfg.ConnByteRate)
+		strikes := ratelimit.NewStrikes(cfg.RateLimitStrikes)
+		sendRateLimited := func(wait time.Duration) {
+			if payload, err := marshalEnvelope("ERROR", map[string]interface{}{
+				"code":           "RATE_LIMITED",
+				"message":        "sending too fast",
+				"retry_after_ms": (wait + time.Millisecond - 1).Milliseconds(),
+			}); err == nil {
+				conn.EnqueueControl(payload)
+			}
+		}
+
+		// persist stores a message under the next seq, relays it to every
+		// peer in the encoding it negotiated and acknowledges it to the
+		// sender. relayText renders the text envelope for the assigned seq;
+		// nil stores the message without relaying it.
+		persist := func(f *binaryFrame, clientID string, relayText func(seq int) ([]byte, error)) {
+			// Relay-only rooms never store messages: peers get them live
+			// under seq 0, which no history or catch-up will ever resend
+			if room.RelayOnly {
+				f.From = conn.Participant()
+				if relayText != nil {
+					if text, err := relayText(0); err != nil {
+						log.Printf("relay encoding failed for %s: %v\n", f.Type, err)
+					} else {
+						bin, _ := encodeFrame(f)
+						rh.hub.BroadcastMessage(0, text, bin, conn)
+					}
+				}
+				// Messages still count as activity for the idle timeout
+				if room.IdleTimeout > 0 {
+					_ = rooms.Touch(db, token)
+				}
+				if ack, err := marshalEnvelope("ACK", map[string]interface{}{
+					"id":  clientID,
+					"seq": 0,
+					"ts":  time.Now().Unix(),
+				}); err == nil {
+					conn.EnqueueControl(ack)
+				}
+				return
+			}
+
+			// Hold the room's order lock from seq allocation through relay
+			// so peers, and catch-up readers, see messages in seq order.
+			rh.order.Lock()
+			createdAt := time.Now().Unix()
+			seq, err := rooms.InsertMessage(
+				db,
+				token,
+				f.Nonce,
+				f.Ciphertext,
+				createdAt,
+				f.Type,
+				f.TransferID,
+				conn.Participant(),
+				f.Transfer,
+				f.BlobID,
+				rooms.Quota{
+					MaxMessages: cfg.MaxRoomMessages,
+					MaxBytes:    cfg.MaxRoomBytes,
+				},
+			)
+			if err == nil {
+				f.Seq = seq
+				f.From = conn.Participant()
+				if conn.Lagging() {
+					ownSeqs.Store(f.Seq, struct{}{})
+				}
+			}
+			// Relay successfully persisted and re-sequenced message
+			if err == nil && relayText != nil {
+				if text, err := relayText(f.Seq); err != nil {
+					log.Printf("relay encoding failed for %s: %v\n", f.Type, err)
+				} else {
+					bin, _ := encodeFrame(f) // nil for types without a binary form
+					rh.hub.BroadcastMessage(f.Seq, text, bin, conn)
+				}
+			}
+			rh.order.Unlock()
+
+			if err != nil {
+				if errors.Is(err, rooms.ErrQuotaExceeded) {
+					sendMessageError(clientID, "QUOTA_EXCEEDED", "room storage quota exceeded")
+					return
+				}
+				if errors.Is(err, rooms.ErrTransferExists) || errors.Is(err, rooms.ErrTransferInvalid) ||
+					errors.Is(err, rooms.ErrDuplicateChunk) || errors.Is(err, rooms.ErrTransferIncomplete) {
+					sendMessageError(clientID, "TRANSFER_REJECTED", err.Error())
+					return
+				}
+				if errors.Is(err, rooms.ErrBlobUnavailable) {
+					sendMessageError(clientID, "MSG_REJECTED", err.Error())
+					return
+				}
+				log.Printf("InsertMessage failed for %s: %v\n", f.Type, err)
+				sendMessageError(clientID, "MSG_REJECTED", "failed to persist message")
+				return
+			}
+
+			// Tell the sender its message is stored and under which seq
+			if ack, err := marshalEnvelope("ACK", map[string]interface{}{
+				"id":  clientID,
+				"seq": f.Seq,
+				"ts":  createdAt,
+			}); err == nil {
+				conn.EnqueueControl(ack)
+			}
 		}
 
 		// --- reader loop (client → server) ---
 		for {
-			_, data, err := wsconn.Read(r.Context())
+			typ, data, err := wsconn.Read(r.Context())
 			if err != nil {
 				return
 			}
 
+			if wait := ratelimit.Allow(len(data), limiter, rh.limiter); wait > 0 {
+				// Dropped frames cost nothing, but a client that ignores
+				// the hint over and over is cut off. Frames that get
+				// through in between do not clear its strikes; only time does.
+				if strikes.Add() {
+					log.Printf("closing connection %s: rate limit exceeded\n", conn.ID())
+					conn.Close(int(closeRateLimited), "rate limit exceeded")
+					return
+				}
+				sendRateLimited(wait)
+				continue
+			}
+
 			// 🔥 destroy on expiry
 			ok, _ := rooms.Exists(db, token)
 			if !ok {
 				return
 			}
 
+			// Binary frames always carry a persisted message type
+			if typ == websocket.MessageBinary {
+				f, err := decodeFrame(data)
+				if err != nil {
+					sendProtocolError("MSG_REJECTED", "invalid binary frame")
+					continue
+				}
+				policy, code, message := types.check(f.Type, len(data), handshaken)
+				if code == "" && !policy.Persist {
+					code, message = "MSG_REJECTED", "type cannot be sent as a binary frame"
+				}
+				if code != "" {
+					sendMessageError(f.ClientID, code, message)
+					continue
+				}
+				if err := checkTransferHeader(cfg, f.Type, f.Transfer); err != nil {
+					sendMessageError(f.ClientID, "TRANSFER_REJECTED", err.Error())
+					continue
+				}
+				var relayText func(int) ([]byte, error)
+				if policy.Relay {
+					relayText = func(int) ([]byte, error) {
+						return textFrame(f)
+					}
+				}
+				persist(f, f.ClientID, relayText)
+				continue
+			}
+
 			// Validate envelope structure (but remain crypto-agnostic)
 			// We only check that the message has a 't' field, then relay raw bytes
 			var envelope Envelope
@@ -213,25 +683,185 @@ func wsHandler(db *sql.DB) http.HandlerFunc {
 				continue
 			}
 
+			policy, code, message := types.check(envelope.Type, len(envelope.Payload), handshaken)
+			if code != "" {
+				sendProtocolError(code, message)
+				continue
+			}
+
 			if envelope.Type == "READY" {
 				// Parse lastSeenSeq from READY payload if present
 				var readyPayload struct {
-					LastSeenSeq int `json:"lastSeenSeq"`
+					Version       int    `json:"v"`
+					LastSeenSeq   int    `json:"lastSeenSeq"`
+					Frames        string `json:"frames"`
+					HistoryPage   int    `json:"history_page"`
+					HistoryWindow int    `json:"history_window"`
 				}
 				if err := json.Unmarshal(envelope.Payload, &readyPayload); err == nil && readyPayload.LastSeenSeq > 0 {
 					lastSeenSeq = readyPayload.LastSeenSeq
 				}
+				// Clients that predate versioning omit v and speak version 1
+				if readyPayload.Version != 0 && !versionSupported(readyPayload.Version) {
+					sendProtocolError("UNSUPPORTED_VERSION", "unsupported protocol version")
+					conn.Close(int(closeUnsupported), "unsupported protocol version")
+					return
+				}
+				handshaken = true
+				// Opt in to binary frames for history and relayed messages
+				if readyPayload.Frames == "binary" {
+					conn.SetBinary(true)
+				}
 
-				if err := sendHistory(); err != nil {
-					log.Println("history replay failed:", err)
+				// Offer to resume uploads this participant left unfinished,
+				// now that the client may send chunks
+				if transfers, err := rooms.PendingTransfers(db, token, participant); err != nil {
+					log.Println("PendingTransfers failed:", err)
+				} else {
+					sendTransferState(conn, transfers)
+				}
+
+				// Replay up to the latest seq now; anything newer arrives live.
+				// Relay-only rooms have nothing to replay.
+				if replay == nil && !room.RelayOnly {
+					untilSeq, err := rh.latestSeq(db, token)
+					if err != nil {
+						log.Println("LatestSeq failed:", err)
+						sendProtocolError("HISTORY_UNAVAILABLE", "failed to load history")
+						continue
+					}
+					replay = newHistoryReplay(db, token, conn, lastSeenSeq, untilSeq,
+						readyPayload.HistoryPage, readyPayload.HistoryWindow)
+					workers.Add(1)
+					go func() {
+						defer workers.Done()
+						if err := replay.run(); err != nil {
+							log.Println("history replay failed:", err)
+						}
+					}()
 				}
 				// Don't relay READY to other peers (history is per-client)
 				continue
 			}
 
-			// Persist MSG, IMG_META, IMG_CHUNK, IMG_END for history replay
-			if envelope.Type == "MSG" || envelope.Type == "IMG_META" || envelope.Type == "IMG_CHUNK" || envelope.Type == "IMG_END" {
+			if envelope.Type == "HISTORY_MORE" {
+				var more struct {
+					Pages int `json:"pages"`
+				}
+				_ = json.Unmarshal(envelope.Payload, &more)
+				if replay != nil {
+					replay.grant(more.Pages)
+				}
+				continue
+			}
+
+			// READ advances the read position shared by all of this
+			// participant's devices
+			if envelope.Type == "READ" {
+				var readPayload struct {
+					Seq int `json:"seq"`
+				}
+				if err := json.Unmarshal(envelope.Payload, &readPayload); err != nil || readPayload.Seq < 0 {
+					sendProtocolError("READ_REJECTED", "invalid payload")
+					continue
+				}
+				seq, err := rooms.MarkRead(db, token, participant, readPayload.Seq)
+				if err != nil {
+					log.Println("MarkRead failed:", err)
+					sendProtocolError("READ_REJECTED", "failed to save read position")
+					continue
+				}
+				if msg, err := marshalEnvelope("READ_STATE", map[string]int{"seq": seq}); err == nil {
+					rh.hub.SendToParticipant(participant, msg, conn)
+				}
+				continue
+			}
+
+			// DELIVERED acknowledges every message up to seq for this
+			// participant; delete-on-delivery rooms drop what everyone has
+			if envelope.Type == "DELIVERED" {
+				var deliveredPayload struct {
+					Seq int `json:"seq"`
+				}
+				if err := json.Unmarshal(envelope.Payload, &deliveredPayload); err != nil || deliveredPayload.Seq < 0 {
+					sendProtocolError("DELIVERED_REJECTED", "invalid payload")
+					continue
+				}
+				if _, err := rooms.MarkDelivered(db, token, participant, deliveredPayload.Seq); err != nil {
+					log.Println("MarkDelivered failed:", err)
+					sendProtocolError("DELIVERED_REJECTED", "failed to save delivery position")
+				}
+				continue
+			}
+
+			// REDACT unsends one of this participant's stored messages
+			if envelope.Type == "REDACT" {
+				var redactPayload struct {
+					Seq int `json:"seq"`
+				}
+				if err := json.Unmarshal(envelope.Payload, &redactPayload); err != nil || redactPayload.Seq <= 0 {
+					sendProtocolError("REDACT_REJECTED", "invalid payload")
+					continue
+				}
+				// Under order, so the redaction reaches everyone after the
+				// message itself
+				rh.order.Lock()
+				tid, err := rooms.RedactMessage(db, token, redactPayload.Seq, participant)
+				if err == nil {
+					if msg, err := redactedEnvelope(redactPayload.Seq, tid, participant); err == nil {
+						rh.hub.Broadcast(msg)
+					}
+				}
+				rh.order.Unlock()
+				switch {
+				case errors.Is(err, rooms.ErrMessageNotFound):
+					sendProtocolError("REDACT_REJECTED", "no such message")
+				case errors.Is(err, rooms.ErrNotSender):
+					sendProtocolError("REDACT_REJECTED", "only the sender can redact a message")
+				case errors.Is(err, rooms.ErrAlreadyRedacted):
+					sendProtocolError("REDACT_REJECTED", "message already redacted")
+				case err != nil:
+					log.Println("RedactMessage failed:", err)
+					sendProtocolError("REDACT_REJECTED", "failed to redact message")
+				}
+				continue
+			}
+
+			if envelope.Type == "EXTEND" {
+				var extendPayload struct {
+					By    json.RawMessage `json:"by"`
+					Admin string          `json:"admin"`
+				}
+				if err := json.Unmarshal(envelope.Payload, &extendPayload); err != nil {
+					sendProtocolError("EXTEND_REJECTED", "invalid payload")
+					continue
+				}
+				if err := rooms.VerifyAdmin(db, token, extendPayload.Admin); err != nil {
+					sendProtocolError("EXTEND_REJECTED", "admin secret required")
+					continue
+				}
+				by, err := parseDuration(extendPayload.By)
+				if err != nil || by <= 0 {
+					sendProtocolError("EXTEND_REJECTED", "invalid duration")
+					continue
+				}
+				// On success every peer, including this one, receives EXTENDED
+				if _, err := extendRoom(db, cfg, token, by); err != nil {
+					if errors.Is(err, rooms.ErrLifetimeExceeded) {
+						sendProtocolError("EXTEND_REJECTED", "room maximum lifetime reached")
+					} else {
+						log.Println("EXTEND failed:", err)
+						sendProtocolError("EXTEND_REJECTED", "failed to extend room")
+					}
+				}
+				continue
+			}
+
+			// Persist message types for history replay
+			if policy.Persist {
 				var payload struct {
+					ID         string `json:"id,omitempty"`
+					TransferID string `json:"tid,omitempty"`
 					Seq        int    `json:"seq"`
 					Nonce      string `json:"nonce"`
 					Ciphertext string `json:"ciphertext"`
@@ -254,52 +884,84 @@ func wsHandler(db *sql.DB) http.HandlerFunc {
 
 				if payload.Seq < 0 || nonce == "" || ciphertext == "" {
 					log.Println("invalid MSG payload")
-					sendProtocolError("MSG_REJECTED", "invalid sequence or payload")
+					sendMessageError(payload.ID, "MSG_REJECTED", "invalid sequence or payload")
 					continue
 				}
 
 				nonceBytes, err := decodeBase64(nonce)
 				if err != nil {
 					log.Println("invalid MSG nonce encoding")
-					sendProtocolError("MSG_REJECTED", "invalid or duplicate seq")
+					sendMessageError(payload.ID, "MSG_REJECTED", "invalid or duplicate seq")
 					continue
 				}
 				cipherBytes, err := decodeBase64(ciphertext)
 				if err != nil {
 					log.Println("invalid MSG ciphertext encoding")
-					sendProtocolError("MSG_REJECTED", "invalid or duplicate seq")
+					sendMessageError(payload.ID, "MSG_REJECTED", "invalid or duplicate seq")
 					continue
 				}
 
-				assignedSeq := rh.NextSeq()
-				if err := rooms.InsertMessage(
-					db,
-					token,
-					assignedSeq,
-					nonceBytes,
-					cipherBytes,
-					time.Now().Unix(),
-					envelope.Type,
-				); err != nil {
-					log.Printf("InsertMessage failed for %s: %v\n", envelope.Type, err)
-					sendProtocolError("MSG_REJECTED", "failed to persist message")
+				if len(payload.TransferID) > 255 {
+					sendMessageError(payload.ID, "MSG_REJECTED", "transfer id too long")
 					continue
 				}
 
-				// Update the relayed envelope with the server-assigned sequence
-				// This ensures all clients have a consistent global ordering
-				payload.Seq = assignedSeq
-				updatedPayload, _ := json.Marshal(payload)
-				envelope.Payload = updatedPayload
-				updatedEnvelope, _ := json.Marshal(envelope)
+				// The plaintext transfer header is for the server only and
+				// is left out of the relayed payload
+				var fields transferFields
+				_ = json.Unmarshal(envelope.Payload, &fields)
+				transfer := fields.header(envelope.Type)
+				if err := checkTransferHeader(cfg, envelope.Type, transfer); err != nil {
+					sendMessageError(payload.ID, "TRANSFER_REJECTED", err.Error())
+					continue
+				}
 
-				// Relay successfully persisted and re-sequenced message
-				rh.hub.BroadcastExcept(updatedEnvelope, conn)
+				// A plaintext blob id hands the blob to this message, so it
+				// is deleted with it; like the header it is not relayed
+				var ref struct {
+					Blob string `json:"blob"`
+				}
+				_ = json.Unmarshal(envelope.Payload, &ref)
+				if ref.Blob != "" && !rooms.ValidBlobID(ref.Blob) {
+					sendMessageError(payload.ID, "MSG_REJECTED", "invalid blob id")
+					continue
+				}
+
+				var relayText func(int) ([]byte, error)
+				if policy.Relay {
+					relayText = func(seq int) ([]byte, error) {
+						// Update the relayed envelope with the server-assigned sequence
+						// This ensures all clients have a consistent global ordering
+						payload.Seq = seq
+						updatedPayload, err := json.Marshal(payload)
+						if err != nil {
+							return nil, err
+						}
+						envelope.Payload = updatedPayload
+						envelope.From = conn.Participant()
+						return json.Marshal(envelope)
+					}
+				}
+				persist(&binaryFrame{
+					Type:       envelope.Type,
+					TransferID: payload.TransferID,
+					Transfer:   transfer,
+					BlobID:     ref.Blob,
+					Nonce:      nonceBytes,
+					Ciphertext: cipherBytes,
+				}, payload.ID, relayText)
 				continue
 			}
 
-			// Relay other non-persisted messages
-			rh.hub.BroadcastExcept(data, conn)
+			// Relay other non-persisted messages, stamped with the sender
+			if policy.Relay {
+				envelope.From = conn.Participant()
+				out, err := json.Marshal(envelope)
+				if err != nil {
+					continue
+				}
+				rh.hub.BroadcastExcept(out, conn)
+			}
 		}
 	}
 }
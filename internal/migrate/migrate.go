@@ -18,10 +18,15 @@ type Migration struct {
 	Path    string
 }
 
+// Hook is Go code that runs inside a migration's transaction, after its
+// SQL file. Use it for data rewrites SQL alone cannot express.
+type Hook func(tx *sql.Tx) error
+
 // Runner handles database migrations
 type Runner struct {
 	db            *sql.DB
 	migrationsDir string
+	hooks         map[int]Hook
 }
 
 // NewRunner creates a new migration runner
@@ -29,9 +34,16 @@ func NewRunner(db *sql.DB, migrationsDir string) *Runner {
 	return &Runner{
 		db:            db,
 		migrationsDir: migrationsDir,
+		hooks:         make(map[int]Hook),
 	}
 }
 
+// AddHook registers Go code to run after the SQL of the given migration
+// version. The hook only runs when that migration is applied.
+func (r *Runner) AddHook(version int, hook Hook) {
+	r.hooks[version] = hook
+}
+
 // Run executes all pending migrations
 func (r *Runner) Run() error {
 	// Ensure schema_migrations table exists
@@ -170,6 +182,13 @@ func (r *Runner) applyMigration(m Migration) error {
 		return fmt.Errorf("failed to execute migration SQL: %w", err)
 	}
 
+	// Run the Go hook registered for this version, if any
+	if hook := r.hooks[m.Version]; hook != nil {
+		if err := hook(tx); err != nil {
+			return fmt.Errorf("failed to run migration hook: %w", err)
+		}
+	}
+
 	// Record migration in schema_migrations
 	timestamp := currentUnixTimestamp()
 	_, err = tx.Exec(
@@ -0,0 +1,140 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// bucket is a token bucket holding up to burst tokens and refilling at
+// rate tokens per second. A zero rate means unlimited.
+type bucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newBucket(rate int64, burstSeconds float64) bucket {
+	burst := float64(rate) * burstSeconds
+	return bucket{rate: float64(rate), burst: burst, tokens: burst}
+}
+
+func (b *bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// wait returns how long until n tokens are available. Costs larger than
+// the burst only need a full bucket, so they are slow but never refused
+// outright.
+func (b *bucket) wait(n float64) time.Duration {
+	if b.rate == 0 {
+		return 0
+	}
+	n = math.Min(n, b.burst)
+	if b.tokens >= n {
+		return 0
+	}
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *bucket) take(n float64) {
+	if b.rate == 0 {
+		return
+	}
+	b.tokens = math.Max(0, b.tokens-math.Min(n, b.burst))
+}
+
+// Limiter caps messages per second and bytes per second. It allows bursts
+// of up to BurstSeconds worth of either.
+type Limiter struct {
+	mu    sync.Mutex
+	msgs  bucket
+	bytes bucket
+}
+
+// BurstSeconds is how much unused allowance a limiter saves up.
+const BurstSeconds = 2
+
+// New returns a limiter for msgsPerSec and bytesPerSec, where 0 leaves
+// that dimension unlimited. It returns nil when both are 0; a nil
+// *Limiter allows everything.
+func New(msgsPerSec, bytesPerSec int64) *Limiter {
+	if msgsPerSec <= 0 && bytesPerSec <= 0 {
+		return nil
+	}
+	return &Limiter{
+		msgs:  newBucket(max(msgsPerSec, 0), BurstSeconds),
+		bytes: newBucket(max(bytesPerSec, 0), BurstSeconds),
+	}
+}
+
+// Allow charges one message of size bytes against every limiter, or
+// against none of them. It returns 0 on success and otherwise how long
+// the caller should wait before trying again.
+//
+// Limiters are locked in argument order, so callers must always pass
+// them in the same order (e.g. connection before room).
+func Allow(size int, limiters ...*Limiter) time.Duration {
+	return allowAt(time.Now(), size, limiters...)
+}
+
+func allowAt(now time.Time, size int, limiters ...*Limiter) time.Duration {
+	var wait time.Duration
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.msgs.refill(now)
+		l.bytes.refill(now)
+		wait = max(wait, l.msgs.wait(1), l.bytes.wait(float64(size)))
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, l := range limiters {
+		if l == nil {
+			continue
+		}
+		l.msgs.take(1)
+		l.bytes.take(float64(size))
+	}
+	return 0
+}
+
+// StrikeDecay is how long it takes for one strike to be forgiven.
+const StrikeDecay = time.Second
+
+// Strikes counts refused messages, forgiving one every StrikeDecay. A
+// client refused now and then never reaches the limit, but one that keeps
+// sending faster than it is allowed does, even though some of its messages
+// still get through. It is not safe for concurrent use.
+type Strikes struct {
+	limit float64
+	count float64
+	last  time.Time
+}
+
+// NewStrikes returns a counter that trips after limit strikes.
+func NewStrikes(limit int) *Strikes {
+	return &Strikes{limit: float64(limit)}
+}
+
+// Add records a refused message and reports whether the limit is reached.
+func (s *Strikes) Add() bool {
+	return s.addAt(time.Now())
+}
+
+func (s *Strikes) addAt(now time.Time) bool {
+	if !s.last.IsZero() {
+		s.count = math.Max(0, s.count-float64(now.Sub(s.last))/float64(StrikeDecay))
+	}
+	s.last = now
+	s.count++
+	return s.count >= s.limit
+}
@@ -0,0 +1,163 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBucketRefill(t *testing.T) {
+	start := time.Unix(1000, 0)
+	b := newBucket(10, BurstSeconds)
+	b.refill(start)
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		take    float64
+		need    float64
+		want    time.Duration
+	}{
+		{"full bucket", 0, 0, 20, 0},
+		{"drained", 0, 20, 1, 100 * time.Millisecond},
+		{"half refilled", 50 * time.Millisecond, 0, 1, 50 * time.Millisecond},
+		{"refilled", 100 * time.Millisecond, 0, 1, 0},
+		{"capped at burst", time.Hour, 0, 20, 0},
+		{"more than burst needs a full bucket", 0, 0, 1000, 0},
+		{"more than burst after one token", 0, 1, 1000, 100 * time.Millisecond},
+	}
+	now := start
+	for _, tt := range tests {
+		now = now.Add(tt.elapsed)
+		b.refill(now)
+		b.take(tt.take)
+		if got := b.wait(tt.need); got != tt.want {
+			t.Fatalf("%s: wait(%v) = %v, want %v (tokens %v)", tt.name, tt.need, got, tt.want, b.tokens)
+		}
+	}
+	if b.tokens > b.burst {
+		t.Fatalf("tokens %v exceed burst %v", b.tokens, b.burst)
+	}
+}
+
+func TestBucketUnlimited(t *testing.T) {
+	b := newBucket(0, BurstSeconds)
+	b.refill(time.Now())
+	b.take(1e9)
+	if got := b.wait(1e9); got != 0 {
+		t.Fatalf("unlimited bucket wait = %v, want 0", got)
+	}
+}
+
+func TestNew(t *testing.T) {
+	if l := New(0, 0); l != nil {
+		t.Fatalf("New(0, 0) = %v, want nil", l)
+	}
+	if l := New(-1, 0); l != nil {
+		t.Fatalf("New(-1, 0) = %v, want nil", l)
+	}
+	if l := New(1, 0); l == nil {
+		t.Fatal("New(1, 0) = nil")
+	}
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name    string
+		msgs    int64
+		bytes   int64
+		sizes   []int
+		allowed int // how many of sizes pass, in order
+	}{
+		{"unlimited", 0, 0, []int{1 << 30, 1 << 30, 1 << 30}, 3},
+		{"message burst", 5, 0, make([]int, 11), 10},
+		{"byte burst", 0, 100, []int{150, 50, 1}, 2},
+		{"oversized message needs a full bucket", 0, 100, []int{1000, 1}, 1},
+		{"either limit refuses", 100, 10, []int{10, 10, 1}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.msgs, tt.bytes)
+			for i, size := range tt.sizes {
+				wait := Allow(size, l)
+				if i < tt.allowed && wait != 0 {
+					t.Fatalf("message %d refused, wait %v", i, wait)
+				}
+				if i >= tt.allowed && wait <= 0 {
+					t.Fatalf("message %d allowed, want it refused", i)
+				}
+			}
+		})
+	}
+}
+
+// A message refused by one limiter is charged to none of them.
+func TestAllowAllOrNothing(t *testing.T) {
+	conn := New(10, 0) // burst 20
+	room := New(1, 0)  // burst 2
+
+	for i := 0; i < 2; i++ {
+		if wait := Allow(0, conn, room); wait != 0 {
+			t.Fatalf("message %d refused, wait %v", i, wait)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if wait := Allow(0, conn, room); wait <= 0 {
+			t.Fatalf("message %d allowed past the room limit", i)
+		}
+	}
+
+	// conn was only charged for the two messages the room let through
+	for i := 0; i < 18; i++ {
+		if wait := Allow(0, conn); wait != 0 {
+			t.Fatalf("conn refused message %d after refused room messages, wait %v", i, wait)
+		}
+	}
+	if wait := Allow(0, conn); wait <= 0 {
+		t.Fatal("conn allowed more than its burst")
+	}
+}
+
+func TestAllowNil(t *testing.T) {
+	if wait := Allow(100, nil, nil); wait != 0 {
+		t.Fatalf("nil limiters wait = %v, want 0", wait)
+	}
+}
+
+// flood sends at rate times the limiter's message rate for d and reports
+// whether the strikes tripped.
+func flood(limit int64, rate float64, d time.Duration) bool {
+	l := New(limit, 0)
+	strikes := NewStrikes(20)
+	start := time.Unix(1000, 0)
+	step := time.Duration(float64(time.Second) / (float64(limit) * rate))
+	for now := start; now.Before(start.Add(d)); now = now.Add(step) {
+		if allowAt(now, 1, l) > 0 && strikes.addAt(now) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStrikesSustainedFlood(t *testing.T) {
+	for _, rate := range []float64{1.5, 10, 19} {
+		if !flood(100, rate, 10*time.Second) {
+			t.Fatalf("flood at %vx the limit was never cut off", rate)
+		}
+	}
+}
+
+func TestStrikesWithinLimit(t *testing.T) {
+	if flood(100, 0.9, time.Minute) {
+		t.Fatal("client within the limit was cut off")
+	}
+
+	// One refusal every two seconds is forgiven before the next
+	s := NewStrikes(2)
+	now := time.Unix(1000, 0)
+	for i := 0; i < 100; i++ {
+		if s.addAt(now) {
+			t.Fatalf("occasional refusal %d tripped the strikes", i)
+		}
+		now = now.Add(2 * time.Second)
+	}
+}
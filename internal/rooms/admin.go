@@ -0,0 +1,63 @@
+package rooms
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// ErrForbidden is returned when an admin secret is missing or wrong.
+var ErrForbidden = errors.New("admin secret required")
+
+func hashAdminSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// VerifyAdmin checks the admin secret minted by Create. Rooms created before
+// admin secrets existed have no hash and cannot be managed.
+func VerifyAdmin(db *sql.DB, token, secret string) error {
+	now := time.Now().Unix()
+
+	var stored sql.NullString
+	err := db.QueryRow(`
+		SELECT admin_hash FROM ephemeral_rooms
+		WHERE id = ? AND expires_at > ?
+		  AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, ID(token), now, now).Scan(&stored)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	if secret == "" || !stored.Valid {
+		return ErrForbidden
+	}
+	if subtle.ConstantTimeCompare([]byte(hashAdminSecret(secret)), []byte(stored.String)) != 1 {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// SetLocked locks or unlocks a room. Locked rooms refuse new connections.
+func SetLocked(db *sql.DB, token string, locked bool) error {
+	now := time.Now().Unix()
+	res, err := db.Exec(`
+		UPDATE ephemeral_rooms
+		SET locked = ?
+		WHERE id = ? AND expires_at > ?
+		  AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, locked, ID(token), now, now)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
@@ -0,0 +1,307 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrBlobNotFound is returned when the room has no blob with the id.
+	ErrBlobNotFound = errors.New("blob not found")
+
+	// ErrBlobEmpty is returned for an upload without any bytes.
+	ErrBlobEmpty = errors.New("blob is empty")
+
+	// ErrBlobBody wraps errors reading an upload, as opposed to storing it.
+	ErrBlobBody = errors.New("failed to read blob")
+
+	// ErrBlobUnavailable is returned when a message references a blob the
+	// room does not have or another message already references.
+	ErrBlobUnavailable = errors.New("blob not found or already referenced")
+)
+
+// blobDir holds blob contents, one subdirectory per room ID with one file
+// per blob; the database only records their size and owner.
+var blobDir string
+
+// SetBlobDir sets the directory blob contents are stored under. It must be
+// called once at startup, before requests are served.
+func SetBlobDir(dir string) {
+	blobDir = dir
+}
+
+func blobPath(roomID, id string) string {
+	return filepath.Join(blobDir, roomID, id)
+}
+
+// Blob is an opaque upload stored alongside a room's messages. The server
+// never sees its key; messages reference it by id.
+type Blob struct {
+	ID        string
+	Size      int64
+	CreatedAt time.Time
+	file      *os.File
+}
+
+// Content reads the blob's bytes. Readers may seek and read ranges
+// without loading the rest.
+func (b *Blob) Content() *io.SectionReader {
+	return io.NewSectionReader(b.file, 0, b.Size)
+}
+
+// Close releases the file behind Content.
+func (b *Blob) Close() error {
+	return b.file.Close()
+}
+
+// ValidBlobID reports whether id has the shape of an id returned by PutBlob.
+func ValidBlobID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// bodyReader remembers the error reading an upload, so it can be told
+// apart from errors writing it to disk.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// PutBlob streams body to storage for a live room and returns the new
+// blob's id and size. The bytes count toward the same quota.MaxBytes as
+// messages; blobs are not messages and leave the message count alone.
+// Errors reading body are wrapped in ErrBlobBody.
+func PutBlob(db *sql.DB, token string, body io.Reader, quota Quota) (string, int64, error) {
+	roomID := ID(token)
+
+	b := make([]byte, 16)
+	rand.Read(b)
+	id := hex.EncodeToString(b)
+
+	// The body goes to a temporary file first; it is counted toward the
+	// quota and published under its id once its size is known
+	dir := filepath.Join(blobDir, roomID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", 0, err
+	}
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name()) // fails harmlessly once renamed
+
+	br := &bodyReader{r: body}
+	size, err := io.Copy(tmp, br)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if br.err != nil {
+		return "", 0, fmt.Errorf("%w: %w", ErrBlobBody, br.err)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if size == 0 {
+		return "", 0, ErrBlobEmpty
+	}
+
+	now := time.Now().Unix()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", 0, err
+	}
+
+	var expiresValue interface{}
+	var ciphertextBytes int64
+	err = tx.QueryRow(`
+		SELECT expires_at, ciphertext_bytes FROM ephemeral_rooms
+		WHERE id = ? AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, roomID, now).Scan(&expiresValue, &ciphertextBytes)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", 0, ErrNotFound
+		}
+		return "", 0, err
+	}
+
+	expiresAt, err := parseUnixValue(expiresValue)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", 0, err
+	}
+	if expiresAt <= now {
+		_ = tx.Rollback()
+		return "", 0, ErrNotFound
+	}
+
+	if quota.MaxBytes > 0 && ciphertextBytes+size > quota.MaxBytes {
+		_ = tx.Rollback()
+		return "", 0, ErrQuotaExceeded
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET last_activity_at = ?,
+		    ciphertext_bytes = ciphertext_bytes + ?
+		WHERE id = ?
+	`, now, size, roomID); err != nil {
+		_ = tx.Rollback()
+		return "", 0, err
+	}
+
+	if _, err := tx.Exec(`
+		INSERT INTO ephemeral_blobs (room_id, id, size, created_at)
+		VALUES (?, ?, ?, ?)
+	`, roomID, id, size, now); err != nil {
+		_ = tx.Rollback()
+		return "", 0, err
+	}
+
+	// Publish the file before the row: a reader that finds the row must
+	// find the file too
+	if err := os.Rename(tmp.Name(), blobPath(roomID, id)); err != nil {
+		_ = tx.Rollback()
+		return "", 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		_ = os.Remove(blobPath(roomID, id))
+		return "", 0, err
+	}
+
+	return id, size, nil
+}
+
+// OpenBlob opens the room's blob with the given id; callers must Close it.
+// Callers check that the room is still live; blobs of expired rooms linger
+// until cleanup.
+func OpenBlob(db *sql.DB, token, id string) (*Blob, error) {
+	roomID := ID(token)
+
+	blob := Blob{ID: id}
+	var createdAt int64
+	err := db.QueryRow(`
+		SELECT size, created_at FROM ephemeral_blobs
+		WHERE room_id = ? AND id = ?
+	`, roomID, id).Scan(&blob.Size, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	blob.CreatedAt = time.Unix(createdAt, 0)
+
+	// The blob may have been deleted since the lookup; once open, the file
+	// stays readable even if it is
+	blob.file, err = os.Open(blobPath(roomID, id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &blob, nil
+}
+
+// claimBlob checks that the room has blob id and no message references it
+// yet, inside the transaction that stores the message referencing it.
+func claimBlob(tx *sql.Tx, roomID, id string) error {
+	var claimed bool
+	err := tx.QueryRow(`
+		SELECT EXISTS (SELECT 1 FROM ephemeral_messages WHERE room_id = ? AND blob_id = ?)
+		FROM ephemeral_blobs WHERE room_id = ? AND id = ?
+	`, roomID, id, roomID, id).Scan(&claimed)
+	if errors.Is(err, sql.ErrNoRows) || err == nil && claimed {
+		return ErrBlobUnavailable
+	}
+	return err
+}
+
+// releaseBlobs deletes the blobs referenced by the room's messages matching
+// cond, a condition on ephemeral_messages aliased m, and takes them off the
+// room's usage. It returns their ids; callers remove the files with
+// removeBlobFiles once the transaction commits.
+func releaseBlobs(tx *sql.Tx, roomID, cond string, args ...interface{}) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT b.id, b.size FROM ephemeral_blobs b
+		JOIN ephemeral_messages m ON m.room_id = b.room_id AND m.blob_id = b.id
+		WHERE b.room_id = ? AND (`+cond+`)
+	`, append([]interface{}{roomID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	var freed int64
+	for rows.Next() {
+		var id string
+		var size int64
+		if err := rows.Scan(&id, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		freed += size
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	for _, id := range ids {
+		if _, err := tx.Exec(`
+			DELETE FROM ephemeral_blobs WHERE room_id = ? AND id = ?
+		`, roomID, id); err != nil {
+			return nil, err
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET ciphertext_bytes = MAX(ciphertext_bytes - ?, 0)
+		WHERE id = ?
+	`, freed, roomID)
+	return ids, err
+}
+
+// removeBlobFiles deletes the files of blobs released by releaseBlobs.
+func removeBlobFiles(roomID string, ids []string) {
+	for _, id := range ids {
+		if err := os.Remove(blobPath(roomID, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Println("removing blob file failed:", err)
+		}
+	}
+}
+
+// removeRoomBlobs deletes the files of every blob of a room whose rows are
+// gone.
+func removeRoomBlobs(roomID string) error {
+	return os.RemoveAll(filepath.Join(blobDir, roomID))
+}
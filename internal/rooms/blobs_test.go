@@ -0,0 +1,160 @@
+package rooms
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func putTestBlob(t *testing.T, db *sql.DB, token string, data []byte) string {
+	t.Helper()
+	id, size, err := PutBlob(db, token, bytes.NewReader(data), Quota{})
+	if err != nil {
+		t.Fatalf("PutBlob: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("PutBlob size = %d, want %d", size, len(data))
+	}
+	return id
+}
+
+// insertBlobMessage stores an IMG_META owning blobID and returns its seq.
+func insertBlobMessage(t *testing.T, db *sql.DB, token, blobID string) int {
+	t.Helper()
+	seq, err := InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), TransferStart, "t1", "sender", nil, blobID, Quota{})
+	if err != nil {
+		t.Fatalf("InsertMessage: %v", err)
+	}
+	return seq
+}
+
+func roomBytes(t *testing.T, db *sql.DB, token string) int64 {
+	t.Helper()
+	room, err := Get(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return room.CiphertextBytes
+}
+
+func assertBlobGone(t *testing.T, db *sql.DB, token, id string) {
+	t.Helper()
+	if _, err := OpenBlob(db, token, id); !errors.Is(err, ErrBlobNotFound) {
+		t.Fatalf("OpenBlob after release: %v, want ErrBlobNotFound", err)
+	}
+	if _, err := os.Stat(blobPath(ID(token), id)); !os.IsNotExist(err) {
+		t.Fatalf("blob file still there: %v", err)
+	}
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+	data := []byte(strings.Repeat("0123456789", 100))
+	id := putTestBlob(t, db, token, data)
+
+	blob, err := OpenBlob(db, token, id)
+	if err != nil {
+		t.Fatalf("OpenBlob: %v", err)
+	}
+	defer blob.Close()
+
+	got, err := io.ReadAll(blob.Content())
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("content = %d bytes (%v), want the %d uploaded", len(got), err, len(data))
+	}
+	part := make([]byte, 10)
+	if _, err := blob.Content().ReadAt(part, 505); err != nil || string(part) != "5678901234" {
+		t.Fatalf("ReadAt(505) = %q, %v", part, err)
+	}
+	if got := roomBytes(t, db, token); got != int64(len(data)) {
+		t.Fatalf("room bytes = %d, want %d", got, len(data))
+	}
+}
+
+func TestPutBlobRejects(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+
+	if _, _, err := PutBlob(db, token, strings.NewReader(""), Quota{}); !errors.Is(err, ErrBlobEmpty) {
+		t.Fatalf("empty upload: %v, want ErrBlobEmpty", err)
+	}
+	if _, _, err := PutBlob(db, token, strings.NewReader("12345"), Quota{MaxBytes: 4}); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("upload over quota: %v, want ErrQuotaExceeded", err)
+	}
+	broken := io.MultiReader(strings.NewReader("12"), errReader{})
+	if _, _, err := PutBlob(db, token, broken, Quota{}); !errors.Is(err, ErrBlobBody) {
+		t.Fatalf("failed read: %v, want ErrBlobBody", err)
+	}
+
+	// Nothing refused is left behind, on disk or in the quota
+	entries, err := os.ReadDir(filepath.Join(blobDir, ID(token)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("refused uploads left %d files", len(entries))
+	}
+	if got := roomBytes(t, db, token); got != 0 {
+		t.Fatalf("room bytes = %d after refused uploads, want 0", got)
+	}
+}
+
+type errReader struct{}
+
+func (errReader) Read([]byte) (int, error) { return 0, errors.New("connection reset") }
+
+func TestBlobClaimedOnce(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+	id := putTestBlob(t, db, token, []byte("blob"))
+
+	insertBlobMessage(t, db, token, id)
+	_, err := InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), TransferStart, "t2", "sender", nil, id, Quota{})
+	if !errors.Is(err, ErrBlobUnavailable) {
+		t.Fatalf("second claim: %v, want ErrBlobUnavailable", err)
+	}
+	_, err = InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), TransferStart, "t3", "sender", nil, strings.Repeat("0", 32), Quota{})
+	if !errors.Is(err, ErrBlobUnavailable) {
+		t.Fatalf("unknown blob: %v, want ErrBlobUnavailable", err)
+	}
+}
+
+func TestRedactReleasesBlob(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+	id := putTestBlob(t, db, token, []byte("blob bytes"))
+	seq := insertBlobMessage(t, db, token, id)
+
+	if _, err := RedactMessage(db, token, seq, "sender"); err != nil {
+		t.Fatalf("RedactMessage: %v", err)
+	}
+	assertBlobGone(t, db, token, id)
+	if got := roomBytes(t, db, token); got != 0 {
+		t.Fatalf("room bytes = %d after redaction, want 0", got)
+	}
+}
+
+func TestDeliveryReleasesBlob(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+	joinAll(t, db, token, "a", "b")
+	id := putTestBlob(t, db, token, []byte("blob bytes"))
+	seq := insertBlobMessage(t, db, token, id)
+
+	for _, p := range []string{"a", "b"} {
+		if _, err := MarkDelivered(db, token, p, seq); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertBlobGone(t, db, token, id)
+	if got := roomBytes(t, db, token); got != 0 {
+		t.Fatalf("room bytes = %d after delivery, want 0", got)
+	}
+}
@@ -2,40 +2,79 @@ package rooms
 
 import (
 	"database/sql"
+	"log"
 	"time"
 )
 
-func CleanupExpired(db *sql.DB) error {
+// Reasons reported by CleanupExpired.
+const (
+	ReasonExpired = "expired"
+	ReasonIdle    = "idle"
+)
+
+// Removed identifies a room deleted by CleanupExpired and why.
+type Removed struct {
+	ID     string
+	Reason string
+}
+
+// CleanupExpired deletes rooms that reached their expiry or idle timeout,
+// together with everything stored for them, and returns the rooms that were removed.
+func CleanupExpired(db *sql.DB) ([]Removed, error) {
 	now := time.Now().Unix()
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	if _, err := tx.Exec(`
-		DELETE FROM ephemeral_messages
-		WHERE room_id IN (
-			SELECT id FROM ephemeral_rooms
-			WHERE expires_at <= ?
-		)
-	`, now); err != nil {
+	rows, err := tx.Query(`
+		SELECT id, expires_at <= ? FROM ephemeral_rooms
+		WHERE expires_at <= ?
+		   OR (idle_timeout > 0 AND last_activity_at + idle_timeout <= ?)
+	`, now, now, now)
+	if err != nil {
 		_ = tx.Rollback()
-		return err
+		return nil, err
 	}
 
-	if _, err := tx.Exec(`
-		DELETE FROM ephemeral_rooms
-		WHERE expires_at <= ?
-	`, now); err != nil {
+	var removed []Removed
+	for rows.Next() {
+		var room Removed
+		var expired bool
+		if err := rows.Scan(&room.ID, &expired); err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		room.Reason = ReasonIdle
+		if expired {
+			room.Reason = ReasonExpired
+		}
+		removed = append(removed, room)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
 		_ = tx.Rollback()
-		return err
+		return nil, err
+	}
+
+	for _, room := range removed {
+		if err := deleteRoomRows(tx, room.ID); err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		_ = tx.Rollback()
-		return err
+		return nil, err
 	}
 
-	return nil
+	for _, room := range removed {
+		if err := removeRoomBlobs(room.ID); err != nil {
+			log.Println("removing blob files failed:", err)
+		}
+	}
+	return removed, nil
 }
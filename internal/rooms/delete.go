@@ -1,11 +1,48 @@
 package rooms
 
-import "database/sql"
+import (
+	"database/sql"
+	"log"
+)
 
+// Delete removes a room and all of its persisted messages and blobs.
 func Delete(db *sql.DB, token string) error {
-	_, err := db.Exec(`
-		DELETE FROM ephemeral_rooms
-		WHERE token = ?
-	`, token)
-	return err
+	roomID := ID(token)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := deleteRoomRows(tx, roomID); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+
+	if err := removeRoomBlobs(roomID); err != nil {
+		log.Println("removing blob files failed:", err)
+	}
+	return nil
+}
+
+// deleteRoomRows removes a room and everything stored for it. Callers
+// remove its blob files with removeRoomBlobs once the transaction commits.
+func deleteRoomRows(tx *sql.Tx, roomID string) error {
+	for _, query := range []string{
+		`DELETE FROM ephemeral_messages WHERE room_id = ?`,
+		`DELETE FROM ephemeral_participants WHERE room_id = ?`,
+		`DELETE FROM ephemeral_transfers WHERE room_id = ?`,
+		`DELETE FROM ephemeral_blobs WHERE room_id = ?`,
+		`DELETE FROM ephemeral_rooms WHERE id = ?`,
+	} {
+		if _, err := tx.Exec(query, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
 }
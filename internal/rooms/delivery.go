@@ -0,0 +1,167 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// MarkDelivered advances participantID's acknowledged high-water mark to
+// seq (it never moves backwards) and returns the resulting mark. In a
+// delete-on-delivery room it then deletes every message that all of the
+// room's participants have acknowledged, with the blobs they reference, and
+// frees its quota.
+func MarkDelivered(db *sql.DB, token, participantID string, seq int) (int, error) {
+	roomID := ID(token)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	var deliveredSeq int
+	var deleteOnDelivery bool
+	err = tx.QueryRow(`
+		UPDATE ephemeral_participants
+		SET delivered_seq = MAX(delivered_seq, MIN(?, (SELECT last_seq FROM ephemeral_rooms WHERE id = ephemeral_participants.room_id))),
+		    last_seen_at = ?
+		WHERE room_id = ? AND participant_id = ?
+		RETURNING delivered_seq, (SELECT delete_on_delivery FROM ephemeral_rooms WHERE id = ephemeral_participants.room_id)
+	`, seq, time.Now().Unix(), roomID, participantID).Scan(&deliveredSeq, &deleteOnDelivery)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrNotFound
+		}
+		return 0, err
+	}
+
+	var blobs []string
+	if deleteOnDelivery {
+		if blobs, err = deleteDelivered(tx, roomID); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	removeBlobFiles(roomID, blobs)
+	return deliveredSeq, nil
+}
+
+// deleteDelivered deletes the messages every participant has acknowledged
+// and the blobs they reference, and takes them off the room's usage. It
+// returns the released blob ids for removeBlobFiles. The floor is the
+// lowest acknowledgement among the participants recorded now, forgotten
+// ones no longer count. Nothing is deleted until a second participant has
+// ever joined (unless the room admits only one): until then the only
+// recipient may still be on the way.
+func deleteDelivered(tx *sql.Tx, roomID string) ([]string, error) {
+	var floor int
+	if err := tx.QueryRow(`
+		SELECT COALESCE((
+			SELECT MIN(p.delivered_seq) FROM ephemeral_participants p
+			WHERE p.room_id = ?
+			  AND (SELECT joined_participants >= MIN(max_participants, 2) FROM ephemeral_rooms WHERE id = ?)
+		), 0)
+	`, roomID, roomID).Scan(&floor); err != nil {
+		return nil, err
+	}
+
+	var count int
+	var bytes int64
+	if err := tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(ciphertext)), 0) FROM ephemeral_messages
+		WHERE room_id = ? AND seq <= ?
+	`, roomID, floor).Scan(&count, &bytes); err != nil {
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	blobs, err := releaseBlobs(tx, roomID, `m.seq <= ?`, floor)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM ephemeral_messages WHERE room_id = ? AND seq <= ?
+	`, roomID, floor); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET message_count = MAX(message_count - ?, 0),
+		    ciphertext_bytes = MAX(ciphertext_bytes - ?, 0)
+		WHERE id = ?
+	`, count, bytes, roomID)
+	return blobs, err
+}
+
+// CleanupParticipants forgets participants of delete-on-delivery rooms
+// that have not been seen for timeout, so a device that never comes back
+// cannot keep messages stored for it, and deletes whatever the remaining
+// participants have acknowledged. It returns how many were forgotten.
+func CleanupParticipants(db *sql.DB, timeout time.Duration) (int, error) {
+	cutoff := time.Now().Add(-timeout).Unix()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := tx.Query(`
+		DELETE FROM ephemeral_participants
+		WHERE last_seen_at <= ?
+		  AND room_id IN (SELECT id FROM ephemeral_rooms WHERE delete_on_delivery = 1)
+		RETURNING room_id
+	`, cutoff)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	count := 0
+	roomIDs := make(map[string]bool)
+	for rows.Next() {
+		var roomID string
+		if err := rows.Scan(&roomID); err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return 0, err
+		}
+		roomIDs[roomID] = true
+		count++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	released := make(map[string][]string)
+	for roomID := range roomIDs {
+		blobs, err := deleteDelivered(tx, roomID)
+		if err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		released[roomID] = blobs
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+
+	for roomID, blobs := range released {
+		removeBlobFiles(roomID, blobs)
+	}
+	return count, nil
+}
@@ -0,0 +1,200 @@
+package rooms
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"ephemeral/internal/migrate"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// newTestDB opens a fresh, fully migrated database.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	SetBlobDir(t.TempDir())
+	runner := migrate.NewRunner(db, "../../migrations")
+	runner.AddHook(5, HashTokens)
+	if err := runner.Run(); err != nil {
+		t.Fatalf("migrations: %v", err)
+	}
+	return db
+}
+
+// newDeliveryRoom creates a delete-on-delivery room holding n messages.
+func newDeliveryRoom(t *testing.T, db *sql.DB, maxParticipants, n int) string {
+	t.Helper()
+	token, _, _, err := Create(db, Options{
+		TTL:              time.Hour,
+		MaxParticipants:  maxParticipants,
+		DeleteOnDelivery: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		if _, err := InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), "MSG", "", "sender", nil, "", Quota{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return token
+}
+
+func joinAll(t *testing.T, db *sql.DB, token string, participants ...string) {
+	t.Helper()
+	for _, p := range participants {
+		if _, _, err := JoinParticipant(db, token, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func storedMessages(t *testing.T, db *sql.DB, token string) int {
+	t.Helper()
+	n, err := CountMessages(db, token, 0, 1<<30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDeleteOnDeliveryWaitsForAllParticipants(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 3)
+
+	// The only participant so far acknowledging everything deletes
+	// nothing: the second one has not joined yet
+	joinAll(t, db, token, "a")
+	if _, err := MarkDelivered(db, token, "a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMessages(t, db, token); got != 3 {
+		t.Fatalf("stored = %d before everyone joined, want 3", got)
+	}
+
+	joinAll(t, db, token, "b")
+	if _, err := MarkDelivered(db, token, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMessages(t, db, token); got != 1 {
+		t.Fatalf("stored = %d, want 1", got)
+	}
+}
+
+func TestCleanupParticipantsUnpinsFloor(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 3)
+	joinAll(t, db, token, "a", "b", "gone")
+
+	for _, p := range []string{"a", "b"} {
+		if _, err := MarkDelivered(db, token, p, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storedMessages(t, db, token); got != 3 {
+		t.Fatalf("stored = %d while a participant has not acknowledged, want 3", got)
+	}
+
+	if _, err := db.Exec(`
+		UPDATE ephemeral_participants SET last_seen_at = ? WHERE participant_id = 'gone'
+	`, time.Now().Add(-2*time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	n, err := CleanupParticipants(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("CleanupParticipants forgot %d participants, want 1", n)
+	}
+	if got := storedMessages(t, db, token); got != 0 {
+		t.Fatalf("stored = %d after the absent participant was forgotten, want 0", got)
+	}
+
+	room, err := Get(db, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if room.MessageCount != 0 || room.CiphertextBytes != 0 {
+		t.Fatalf("usage = %d messages, %d bytes, want 0", room.MessageCount, room.CiphertextBytes)
+	}
+}
+
+// In a room for two, forgetting the participant who left must not stop
+// deletion for the one who stayed.
+func TestCleanupParticipantsLastOfTwo(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 3)
+	joinAll(t, db, token, "a", "gone")
+
+	if _, err := MarkDelivered(db, token, "a", 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`
+		UPDATE ephemeral_participants SET last_seen_at = ? WHERE participant_id = 'gone'
+	`, time.Now().Add(-2*time.Hour).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CleanupParticipants(db, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMessages(t, db, token); got != 0 {
+		t.Fatalf("stored = %d after the absent participant was forgotten, want 0", got)
+	}
+
+	// Later messages are deleted as soon as the one left acknowledges them
+	if _, err := InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), "MSG", "", "a", nil, "", Quota{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MarkDelivered(db, token, "a", 4); err != nil {
+		t.Fatal(err)
+	}
+	if got := storedMessages(t, db, token); got != 0 {
+		t.Fatalf("stored = %d after the remaining participant acknowledged, want 0", got)
+	}
+}
+
+// A room that never fills up still deletes what everyone in it has.
+func TestDeleteOnDeliveryBelowCap(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 5, 3)
+	joinAll(t, db, token, "a", "b")
+
+	for _, p := range []string{"a", "b"} {
+		if _, err := MarkDelivered(db, token, p, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := storedMessages(t, db, token); got != 0 {
+		t.Fatalf("stored = %d in a room below its cap, want 0", got)
+	}
+}
+
+// Participants of ordinary rooms keep their read position however long
+// they are away.
+func TestCleanupParticipantsKeepsOtherRooms(t *testing.T) {
+	db := newTestDB(t)
+	token, _, _, err := Create(db, Options{TTL: time.Hour, MaxParticipants: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	joinAll(t, db, token, "a")
+	if _, err := db.Exec(`UPDATE ephemeral_participants SET last_seen_at = 0`); err != nil {
+		t.Fatal(err)
+	}
+	n, err := CleanupParticipants(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Fatalf("CleanupParticipants forgot %d participants of an ordinary room", n)
+	}
+}
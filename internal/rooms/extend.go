@@ -0,0 +1,72 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Extend pushes a room's expiry forward by the given duration, capped at
+// createdAt + maxLifetime. It returns the new expiry.
+func Extend(db *sql.DB, token string, by time.Duration, maxLifetime time.Duration) (time.Time, error) {
+	now := time.Now().Unix()
+	id := ID(token)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var createdValue, expiresValue interface{}
+	if err := tx.QueryRow(`
+		SELECT created_at, expires_at FROM ephemeral_rooms
+		WHERE id = ? AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, id, now).Scan(&createdValue, &expiresValue); err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return time.Time{}, ErrNotFound
+		}
+		return time.Time{}, err
+	}
+
+	createdAt, err := parseUnixValue(createdValue)
+	if err != nil {
+		_ = tx.Rollback()
+		return time.Time{}, err
+	}
+	expiresAt, err := parseUnixValue(expiresValue)
+	if err != nil {
+		_ = tx.Rollback()
+		return time.Time{}, err
+	}
+
+	if expiresAt <= now {
+		_ = tx.Rollback()
+		return time.Time{}, ErrNotFound
+	}
+
+	extended := expiresAt + int64(by/time.Second)
+	if limit := createdAt + int64(maxLifetime/time.Second); extended > limit {
+		extended = limit
+	}
+	if extended <= expiresAt {
+		_ = tx.Rollback()
+		return time.Time{}, ErrLifetimeExceeded
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET expires_at = ?
+		WHERE id = ?
+	`, extended, id); err != nil {
+		_ = tx.Rollback()
+		return time.Time{}, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return time.Time{}, err
+	}
+
+	return time.Unix(extended, 0), nil
+}
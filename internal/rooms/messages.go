@@ -6,100 +6,186 @@ import (
 	"time"
 )
 
+var (
+	// ErrQuotaExceeded is returned when a message would push the room past
+	// its storage quota.
+	ErrQuotaExceeded = errors.New("room storage quota exceeded")
+
+	// ErrMessageNotFound is returned when no stored message has the seq.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrNotSender is returned when someone other than a message's sender
+	// tries to redact it.
+	ErrNotSender = errors.New("not the sender of this message")
+
+	// ErrAlreadyRedacted is returned when redacting a message that already
+	// was.
+	ErrAlreadyRedacted = errors.New("message already redacted")
+)
+
+// Quota limits what a single room may persist. Zero values mean unlimited.
+type Quota struct {
+	MaxMessages int
+	MaxBytes    int64
+}
+
 type MessageRow struct {
 	Seq         int
 	CreatedAt   int64
 	Nonce       []byte
 	Ciphertext  []byte
 	MessageType string
+	TransferID  string
+	SenderID    string
+	// RedactedAt is set (unix seconds) on tombstones of redacted messages,
+	// whose Nonce and Ciphertext are empty.
+	RedactedAt int64
 }
 
+// InsertMessage stores a message under the room's next seq and returns it.
+// The seq is allocated in the same transaction as the insert, so seqs are
+// gap-free and unique even with several servers sharing the database.
+// Messages with a transfer id also advance that transfer, if it is tracked.
+// A message with a blob id takes ownership of that blob, which is deleted
+// along with the message.
 func InsertMessage(
 	db *sql.DB,
-	roomID string,
-	seq int,
+	token string,
 	nonce []byte,
 	ciphertext []byte,
 	createdAt int64,
 	messageType string,
-) error {
+	transferID string,
+	senderID string,
+	transfer *TransferHeader,
+	blobID string,
+	quota Quota,
+) (int, error) {
 	now := time.Now().Unix()
+	roomID := ID(token)
 
 	tx, err := db.Begin()
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	expiresAt, err := scanUnixValueRow(tx.QueryRow(`
-		SELECT expires_at FROM ephemeral_rooms
-		WHERE token = ?
-	`, roomID))
+	var expiresValue interface{}
+	var messageCount int
+	var ciphertextBytes int64
+	err = tx.QueryRow(`
+		SELECT expires_at, message_count, ciphertext_bytes FROM ephemeral_rooms
+		WHERE id = ? AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, roomID, now).Scan(&expiresValue, &messageCount, &ciphertextBytes)
 	if err != nil {
 		_ = tx.Rollback()
 		if errors.Is(err, sql.ErrNoRows) {
-			return errors.New("room not found")
+			return 0, ErrNotFound
 		}
-		return err
+		return 0, err
 	}
 
+	expiresAt, err := parseUnixValue(expiresValue)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
 	if expiresAt <= now {
 		_ = tx.Rollback()
-		return errors.New("room expired")
+		return 0, errors.New("room expired")
+	}
+
+	if quota.MaxMessages > 0 && messageCount+1 > quota.MaxMessages {
+		_ = tx.Rollback()
+		return 0, ErrQuotaExceeded
+	}
+	if quota.MaxBytes > 0 && ciphertextBytes+int64(len(ciphertext)) > quota.MaxBytes {
+		_ = tx.Rollback()
+		return 0, ErrQuotaExceeded
+	}
+
+	if transferID != "" {
+		if err := trackTransfer(tx, roomID, transferID, senderID, messageType, transfer, now); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	if blobID != "" {
+		if err := claimBlob(tx, roomID, blobID); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+	}
+
+	var seq int
+	err = tx.QueryRow(`
+		UPDATE ephemeral_rooms
+		SET last_seq = last_seq + 1,
+		    last_activity_at = ?,
+		    message_count = message_count + 1,
+		    ciphertext_bytes = ciphertext_bytes + ?
+		WHERE id = ?
+		RETURNING last_seq
+	`, now, len(ciphertext), roomID).Scan(&seq)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, err
 	}
 
 	if _, err := tx.Exec(`
-		INSERT INTO ephemeral_messages (room_id, created_at, ciphertext, nonce, seq, message_type)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, roomID, createdAt, ciphertext, nonce, seq, messageType); err != nil {
+		INSERT INTO ephemeral_messages (room_id, created_at, ciphertext, nonce, seq, message_type, transfer_id, sender_id, blob_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, roomID, createdAt, ciphertext, nonce, seq, messageType,
+		sql.NullString{String: transferID, Valid: transferID != ""},
+		sql.NullString{String: senderID, Valid: senderID != ""},
+		sql.NullString{String: blobID, Valid: blobID != ""}); err != nil {
 		_ = tx.Rollback()
-		return err
+		return 0, err
 	}
 
 	if err := tx.Commit(); err != nil {
 		_ = tx.Rollback()
-		return err
+		return 0, err
 	}
 
-	return nil
+	return seq, nil
 }
 
-func GetMaxSeq(db *sql.DB, roomID string) (int, error) {
-	var maxSeq int
+// LatestSeq returns the last seq allocated in the room, 0 if none.
+func LatestSeq(db *sql.DB, token string) (int, error) {
+	var seq int
 	err := db.QueryRow(`
-		SELECT COALESCE(MAX(seq), 0) FROM ephemeral_messages
-		WHERE room_id = ?
-	`, roomID).Scan(&maxSeq)
-	return maxSeq, err
+		SELECT last_seq FROM ephemeral_rooms WHERE id = ?
+	`, ID(token)).Scan(&seq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return seq, err
 }
 
-func GetMessagesSince(
+// GetMessagesPage returns up to limit messages with afterSeq < seq <= untilSeq,
+// oldest first. Callers page through history by passing the last seq they
+// received as the next afterSeq.
+func GetMessagesPage(
 	db *sql.DB,
-	roomID string,
+	token string,
 	afterSeq int,
+	untilSeq int,
+	limit int,
 ) ([]MessageRow, error) {
-	now := time.Now().Unix()
-
-	expiresAt, err := scanUnixValueRow(db.QueryRow(`
-		SELECT expires_at FROM ephemeral_rooms
-		WHERE token = ?
-	`, roomID))
-	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, errors.New("room not found")
-		}
+	roomID := ID(token)
+	if err := checkRoomLive(db, roomID); err != nil {
 		return nil, err
 	}
 
-	if expiresAt <= now {
-		return nil, errors.New("room expired")
-	}
-
 	rows, err := db.Query(`
-		SELECT seq, created_at, nonce, ciphertext, message_type
+		SELECT seq, created_at, nonce, ciphertext, message_type, COALESCE(transfer_id, ''),
+		       COALESCE(sender_id, ''), COALESCE(redacted_at, 0)
 		FROM ephemeral_messages
-		WHERE room_id = ? AND seq > ?
+		WHERE room_id = ? AND seq > ? AND seq <= ?
 		ORDER BY seq ASC
-	`, roomID, afterSeq)
+		LIMIT ?
+	`, roomID, afterSeq, untilSeq, limit)
 	if err != nil {
 		return nil, err
 	}
@@ -108,7 +194,7 @@ func GetMessagesSince(
 	var messages []MessageRow
 	for rows.Next() {
 		var row MessageRow
-		if err := rows.Scan(&row.Seq, &row.CreatedAt, &row.Nonce, &row.Ciphertext, &row.MessageType); err != nil {
+		if err := rows.Scan(&row.Seq, &row.CreatedAt, &row.Nonce, &row.Ciphertext, &row.MessageType, &row.TransferID, &row.SenderID, &row.RedactedAt); err != nil {
 			return nil, err
 		}
 		messages = append(messages, row)
@@ -119,3 +205,34 @@ func GetMessagesSince(
 
 	return messages, nil
 }
+
+// CountMessages returns how many messages have afterSeq < seq <= untilSeq.
+func CountMessages(db *sql.DB, token string, afterSeq, untilSeq int) (int, error) {
+	var count int
+	err := db.QueryRow(`
+		SELECT COUNT(*) FROM ephemeral_messages
+		WHERE room_id = ? AND seq > ? AND seq <= ?
+	`, ID(token), afterSeq, untilSeq).Scan(&count)
+	return count, err
+}
+
+// checkRoomLive returns ErrNotFound unless the room exists and has neither
+// expired nor gone idle.
+func checkRoomLive(db *sql.DB, roomID string) error {
+	now := time.Now().Unix()
+	expiresAt, err := scanUnixValueRow(db.QueryRow(`
+		SELECT expires_at FROM ephemeral_rooms
+		WHERE id = ? AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, roomID, now))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNotFound
+		}
+		return err
+	}
+
+	if expiresAt <= now {
+		return errors.New("room expired")
+	}
+	return nil
+}
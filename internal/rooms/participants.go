@@ -0,0 +1,113 @@
+package rooms
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"time"
+)
+
+// NewParticipantKey returns a random device key for clients that did not
+// bring one. Handing the same key to another device makes it the same
+// participant.
+func NewParticipantKey() string {
+	b := make([]byte, 24)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ValidParticipantKey reports whether key is acceptable as a device key:
+// 16 to 128 URL-safe characters.
+func ValidParticipantKey(key string) bool {
+	if len(key) < 16 || len(key) > 128 {
+		return false
+	}
+	for _, r := range key {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// ParticipantID derives the public participant id for a device key. It is
+// scoped to the room, so the same key in two rooms cannot be linked, and
+// it does not reveal the key.
+func ParticipantID(token, key string) string {
+	sum := sha256.Sum256([]byte(ID(token) + "\x00" + key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// JoinParticipant records that participantID connected to the room and
+// returns the seqs it has read and acknowledged delivery of. A new
+// participant starts out owing acknowledgement for every message still
+// stored; anything already deleted on delivery is behind it.
+func JoinParticipant(db *sql.DB, token, participantID string) (readSeq, deliveredSeq int, err error) {
+	now := time.Now().Unix()
+	roomID := ID(token)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	res, err := tx.Exec(`
+		INSERT INTO ephemeral_participants (room_id, participant_id, joined_at, last_seen_at, delivered_seq)
+		VALUES (?, ?, ?, ?, COALESCE(
+			(SELECT MIN(seq) - 1 FROM ephemeral_messages WHERE room_id = ?),
+			(SELECT last_seq FROM ephemeral_rooms WHERE id = ?),
+			0))
+		ON CONFLICT (room_id, participant_id) DO NOTHING
+	`, roomID, participantID, now, now, roomID, roomID)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	} else if n > 0 {
+		if _, err := tx.Exec(`
+			UPDATE ephemeral_rooms SET joined_participants = joined_participants + 1 WHERE id = ?
+		`, roomID); err != nil {
+			_ = tx.Rollback()
+			return 0, 0, err
+		}
+	}
+
+	err = tx.QueryRow(`
+		UPDATE ephemeral_participants SET last_seen_at = ?
+		WHERE room_id = ? AND participant_id = ?
+		RETURNING read_seq, delivered_seq
+	`, now, roomID, participantID).Scan(&readSeq, &deliveredSeq)
+	if err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return 0, 0, err
+	}
+	return readSeq, deliveredSeq, nil
+}
+
+// MarkRead advances participantID's read position to seq (it never moves
+// backwards) and returns the resulting position.
+func MarkRead(db *sql.DB, token, participantID string, seq int) (int, error) {
+	var readSeq int
+	err := db.QueryRow(`
+		UPDATE ephemeral_participants
+		SET read_seq = MAX(read_seq, MIN(?, (SELECT last_seq FROM ephemeral_rooms WHERE id = ephemeral_participants.room_id))),
+		    last_seen_at = ?
+		WHERE room_id = ? AND participant_id = ?
+		RETURNING read_seq
+	`, seq, time.Now().Unix(), ID(token), participantID).Scan(&readSeq)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrNotFound
+	}
+	return readSeq, err
+}
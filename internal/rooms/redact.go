@@ -0,0 +1,102 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RedactMessage empties the nonce and ciphertext of message seq, leaving a
+// tombstone so the seq stays taken. Only senderID, the participant who
+// stored it, may do so. Redacting any part of a transfer (rows sharing a
+// transfer id) redacts all of it, and deletes any blob the redacted
+// messages reference. It returns the transfer id, if any, and
+// ErrAlreadyRedacted for a tombstone.
+func RedactMessage(db *sql.DB, token string, seq int, senderID string) (string, error) {
+	roomID := ID(token)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+
+	var storedSender, transferID string
+	var redacted bool
+	err = tx.QueryRow(`
+		SELECT COALESCE(sender_id, ''), COALESCE(transfer_id, ''), redacted_at IS NOT NULL
+		FROM ephemeral_messages
+		WHERE room_id = ? AND seq = ?
+	`, roomID, seq).Scan(&storedSender, &transferID, &redacted)
+	if err != nil {
+		_ = tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", ErrMessageNotFound
+		}
+		return "", err
+	}
+	// Messages stored before senders were recorded cannot be redacted
+	if storedSender == "" || storedSender != senderID {
+		_ = tx.Rollback()
+		return "", ErrNotSender
+	}
+	if redacted {
+		_ = tx.Rollback()
+		return "", ErrAlreadyRedacted
+	}
+
+	// Free the ciphertext bytes toward the room quota; the row itself stays
+	var freed int64
+	err = tx.QueryRow(`
+		SELECT COALESCE(SUM(LENGTH(ciphertext)), 0) FROM ephemeral_messages
+		WHERE room_id = ? AND redacted_at IS NULL
+		  AND (seq = ? OR (transfer_id = ? AND sender_id = ?))
+	`, roomID, seq, transferID, senderID).Scan(&freed)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	blobs, err := releaseBlobs(tx, roomID, `
+		m.redacted_at IS NULL AND (m.seq = ? OR (m.transfer_id = ? AND m.sender_id = ?))
+	`, seq, transferID, senderID)
+	if err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_messages
+		SET nonce = x'', ciphertext = x'', blob_id = NULL, redacted_at = ?
+		WHERE room_id = ? AND redacted_at IS NULL
+		  AND (seq = ? OR (transfer_id = ? AND sender_id = ?))
+	`, time.Now().Unix(), roomID, seq, transferID, senderID); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	// A redacted transfer is over; it can no longer be resumed
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_transfers SET completed_at = ?
+		WHERE room_id = ? AND transfer_id = ? AND sender_id = ? AND completed_at IS NULL
+	`, time.Now().Unix(), roomID, transferID, senderID); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET ciphertext_bytes = MAX(ciphertext_bytes - ?, 0)
+		WHERE id = ?
+	`, freed, roomID); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return "", err
+	}
+
+	removeBlobFiles(roomID, blobs)
+	return transferID, nil
+}
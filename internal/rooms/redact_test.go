@@ -0,0 +1,26 @@
+package rooms
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRedactTwice(t *testing.T) {
+	db := newTestDB(t)
+	token := newDeliveryRoom(t, db, 2, 0)
+	seq, err := InsertMessage(db, token, []byte("n"), []byte("c"), time.Now().Unix(), "MSG", "", "sender", nil, "", Quota{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := RedactMessage(db, token, seq, "sender"); err != nil {
+		t.Fatalf("RedactMessage: %v", err)
+	}
+	if _, err := RedactMessage(db, token, seq, "sender"); !errors.Is(err, ErrAlreadyRedacted) {
+		t.Fatalf("second RedactMessage: %v, want ErrAlreadyRedacted", err)
+	}
+	if _, err := RedactMessage(db, token, seq, "other"); !errors.Is(err, ErrNotSender) {
+		t.Fatalf("RedactMessage by another participant: %v, want ErrNotSender", err)
+	}
+}
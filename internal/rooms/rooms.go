@@ -5,27 +5,87 @@ import (
 	"database/sql"
 	"encoding/hex"
 	"ephemeral/internal/notify"
+	"errors"
 	"time"
 )
 
-func Create(db *sql.DB, ttl time.Duration) (string, time.Time, error) {
+var (
+	// ErrNotFound is returned when a room does not exist or has expired.
+	ErrNotFound = errors.New("room not found")
+
+	// ErrLifetimeExceeded is returned when a room is already at its
+	// maximum lifetime and cannot be extended any further.
+	ErrLifetimeExceeded = errors.New("room maximum lifetime reached")
+)
+
+// Options are the per-room settings chosen at creation time.
+type Options struct {
+	TTL             time.Duration
+	MaxParticipants int
+	// IdleTimeout destroys the room after this long without messages or
+	// connection events. Zero disables it.
+	IdleTimeout time.Duration
+	// DeleteOnDelivery deletes each stored message once a second
+	// participant has joined and all current participants have
+	// acknowledged it, instead of keeping it until the room expires.
+	DeleteOnDelivery bool
+	// RelayOnly relays messages to the peers online and never stores them,
+	// so there is no history to replay.
+	RelayOnly bool
+}
+
+// Room is the stored state of a live room.
+type Room struct {
+	CreatedAt        time.Time
+	ExpiresAt        time.Time
+	MaxParticipants  int
+	Locked           bool
+	IdleTimeout      time.Duration
+	LastActivityAt   time.Time
+	MessageCount     int
+	CiphertextBytes  int64
+	DeleteOnDelivery bool
+	RelayOnly        bool
+}
+
+// IdleDeadline returns when the room will be destroyed for inactivity, or
+// the zero time if it has no idle timeout.
+func (r *Room) IdleDeadline() time.Time {
+	if r.IdleTimeout <= 0 {
+		return time.Time{}
+	}
+	return r.LastActivityAt.Add(r.IdleTimeout)
+}
+
+// Create inserts a new room and returns its token and a separate admin
+// secret. Only the room ID derived from the token and a hash of the admin
+// secret are stored, so the caller must hand both to the creator now or never.
+func Create(db *sql.DB, opts Options) (string, string, time.Time, error) {
 	b := make([]byte, 16)
 	rand.Read(b)
-
 	token := hex.EncodeToString(b)
+
+	a := make([]byte, 32)
+	rand.Read(a)
+	adminSecret := hex.EncodeToString(a)
+
 	now := time.Now().Unix()
-	expires := time.Now().Add(ttl).Unix()
+	expires := time.Now().Add(opts.TTL).Unix()
 
 	_, err := db.Exec(`
-		INSERT INTO ephemeral_rooms (token, expires_at, created_at)
-		VALUES (?, ?, ?)
-	`, token, expires, now)
+		INSERT INTO ephemeral_rooms (
+			id, expires_at, created_at, admin_hash, max_participants,
+			idle_timeout, last_activity_at, delete_on_delivery, relay_only
+		)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, ID(token), expires, now, hashAdminSecret(adminSecret), opts.MaxParticipants,
+		int64(opts.IdleTimeout/time.Second), now, opts.DeleteOnDelivery, opts.RelayOnly)
 
 	if err == nil {
-		notify.Emit("room.created", token, ttl.String())
+		notify.Emit("room.created", ID(token), opts.TTL.String())
 	}
 
-	return token, time.Unix(expires, 0), err
+	return token, adminSecret, time.Unix(expires, 0), err
 }
 
 func Exists(db *sql.DB, token string) (bool, error) {
@@ -33,21 +93,104 @@ func Exists(db *sql.DB, token string) (bool, error) {
 	now := time.Now().Unix()
 	err := db.QueryRow(`
 		SELECT COUNT(*) FROM ephemeral_rooms
-		WHERE token = ? AND expires_at > ?
-	`, token, now).Scan(&count)
+		WHERE id = ? AND expires_at > ?
+		  AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, ID(token), now, now).Scan(&count)
 
 	return count == 1, err
 }
 
-func GetExpiry(db *sql.DB, token string) (time.Time, error) {
+// Get returns a live room, or ErrNotFound if it does not exist or expired.
+func Get(db *sql.DB, token string) (*Room, error) {
 	now := time.Now().Unix()
-	expiresAt, err := scanUnixValueRow(db.QueryRow(`
-		SELECT expires_at FROM ephemeral_rooms
-		WHERE token = ? AND expires_at > ?
-	`, token, now))
+
+	var createdValue, expiresValue, activityValue interface{}
+	var idleSeconds int64
+	var room Room
+	err := db.QueryRow(`
+		SELECT created_at, expires_at, max_participants, locked,
+		       idle_timeout, last_activity_at, message_count, ciphertext_bytes,
+		       delete_on_delivery, relay_only
+		FROM ephemeral_rooms
+		WHERE id = ? AND expires_at > ?
+		  AND (idle_timeout = 0 OR last_activity_at + idle_timeout > ?)
+	`, ID(token), now, now).Scan(&createdValue, &expiresValue, &room.MaxParticipants, &room.Locked,
+		&idleSeconds, &activityValue, &room.MessageCount, &room.CiphertextBytes,
+		&room.DeleteOnDelivery, &room.RelayOnly)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
 	if err != nil {
-		return time.Time{}, err
+		return nil, err
 	}
 
-	return time.Unix(expiresAt, 0), nil
+	createdAt, err := parseUnixValue(createdValue)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt, err := parseUnixValue(expiresValue)
+	if err != nil {
+		return nil, err
+	}
+	lastActivity, err := parseUnixValue(activityValue)
+	if err != nil {
+		return nil, err
+	}
+	room.CreatedAt = time.Unix(createdAt, 0)
+	room.ExpiresAt = time.Unix(expiresAt, 0)
+	room.IdleTimeout = time.Duration(idleSeconds) * time.Second
+	room.LastActivityAt = time.Unix(lastActivity, 0)
+
+	return &room, nil
+}
+
+// Touch records activity (a connection opening or closing, or a message
+// in a relay-only room) so the room's idle timeout starts over.
+func Touch(db *sql.DB, token string) error {
+	_, err := db.Exec(`
+		UPDATE ephemeral_rooms
+		SET last_activity_at = ?
+		WHERE id = ?
+	`, time.Now().Unix(), ID(token))
+	return err
+}
+
+// TouchConnected records activity for rooms that still have connections
+// open, and for the participants connected to them, given as participant
+// IDs by room ID. Connected rooms are not idle, nor connected participants
+// inactive, even when nobody is sending anything that gets stored.
+func TouchConnected(db *sql.DB, live map[string][]string) error {
+	if len(live) == 0 {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for roomID, participantIDs := range live {
+		if _, err := tx.Exec(`
+			UPDATE ephemeral_rooms SET last_activity_at = ? WHERE id = ?
+		`, now, roomID); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+		for _, participantID := range participantIDs {
+			if _, err := tx.Exec(`
+				UPDATE ephemeral_participants SET last_seen_at = ?
+				WHERE room_id = ? AND participant_id = ?
+			`, now, roomID, participantID); err != nil {
+				_ = tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return nil
 }
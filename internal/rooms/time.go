@@ -10,7 +10,7 @@ import (
 
 func NormalizeRoomTimestamps(db *sql.DB) error {
 	rows, err := db.Query(`
-		SELECT token, created_at, expires_at
+		SELECT id, created_at, expires_at
 		FROM ephemeral_rooms
 		WHERE typeof(created_at) != 'integer'
 		   OR typeof(expires_at) != 'integer'
@@ -21,27 +21,27 @@ func NormalizeRoomTimestamps(db *sql.DB) error {
 	defer rows.Close()
 
 	for rows.Next() {
-		var token string
+		var id string
 		var createdValue interface{}
 		var expiresValue interface{}
-		if err := rows.Scan(&token, &createdValue, &expiresValue); err != nil {
+		if err := rows.Scan(&id, &createdValue, &expiresValue); err != nil {
 			return err
 		}
 
 		createdAt, err := parseUnixValue(createdValue)
 		if err != nil {
-			return fmt.Errorf("normalize created_at for %s: %w", token, err)
+			return fmt.Errorf("normalize created_at for %s: %w", id, err)
 		}
 		expiresAt, err := parseUnixValue(expiresValue)
 		if err != nil {
-			return fmt.Errorf("normalize expires_at for %s: %w", token, err)
+			return fmt.Errorf("normalize expires_at for %s: %w", id, err)
 		}
 
 		if _, err := db.Exec(`
 			UPDATE ephemeral_rooms
 			SET created_at = ?, expires_at = ?
-			WHERE token = ?
-		`, createdAt, expiresAt, token); err != nil {
+			WHERE id = ?
+		`, createdAt, expiresAt, id); err != nil {
 			return err
 		}
 	}
@@ -0,0 +1,65 @@
+package rooms
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+)
+
+// tokenKey is the server secret used to derive room IDs from tokens.
+var tokenKey []byte
+
+// SetTokenSecret sets the server secret used to derive room IDs. It must be
+// called once at startup, before migrations run and requests are served.
+func SetTokenSecret(secret []byte) {
+	tokenKey = append([]byte(nil), secret...)
+}
+
+// ID derives the stored room ID from a room token. Clients derive their
+// encryption key from the token, so the token itself never reaches the
+// database; without the server secret the ID cannot be reversed.
+func ID(token string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(token))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashTokens rewrites plaintext room tokens stored by older versions into
+// room IDs. It runs as the hook of the migration that introduced them.
+func HashTokens(tx *sql.Tx) error {
+	if err := rehashColumn(tx, `SELECT id FROM ephemeral_rooms`,
+		`UPDATE ephemeral_rooms SET id = ? WHERE id = ?`); err != nil {
+		return err
+	}
+	return rehashColumn(tx, `SELECT DISTINCT room_id FROM ephemeral_messages`,
+		`UPDATE ephemeral_messages SET room_id = ? WHERE room_id = ?`)
+}
+
+func rehashColumn(tx *sql.Tx, selectQuery, updateQuery string) error {
+	rows, err := tx.Query(selectQuery)
+	if err != nil {
+		return err
+	}
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if _, err := tx.Exec(updateQuery, ID(token), token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package rooms
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Message types that make up an image transfer.
+const (
+	TransferStart = "IMG_META"
+	TransferChunk = "IMG_CHUNK"
+	TransferEnd   = "IMG_END"
+)
+
+var (
+	// ErrTransferExists is returned when a transfer id is started twice.
+	ErrTransferExists = errors.New("transfer id already in use")
+
+	// ErrTransferInvalid is returned for a chunk or end of a tracked
+	// transfer that is closed, belongs to someone else or has a bad index.
+	ErrTransferInvalid = errors.New("not part of an open transfer")
+
+	// ErrDuplicateChunk is returned when a chunk index was already stored.
+	ErrDuplicateChunk = errors.New("chunk already received")
+
+	// ErrTransferIncomplete is returned when a transfer is ended before all
+	// of its chunks arrived.
+	ErrTransferIncomplete = errors.New("transfer is missing chunks")
+)
+
+// TransferHeader is the unencrypted part of a transfer frame that lets the
+// server track it: Size and Chunks on TransferStart, Index on each
+// TransferChunk. Transfers started without one are stored untracked, so
+// CleanupTransfers never collects them; their messages stay until the
+// room goes.
+type TransferHeader struct {
+	Size   int64
+	Chunks int
+	Index  int
+}
+
+// Transfer is an incomplete transfer and the chunk indexes stored so far.
+type Transfer struct {
+	ID       string
+	Size     int64
+	Chunks   int
+	Received []int
+}
+
+// StaleTransfer identifies a transfer deleted by CleanupTransfers.
+type StaleTransfer struct {
+	RoomID     string
+	TransferID string
+}
+
+// trackTransfer updates the transfer a message belongs to, inside the
+// transaction that stores the message.
+func trackTransfer(tx *sql.Tx, roomID, transferID, senderID, messageType string, header *TransferHeader, now int64) error {
+	if messageType == TransferStart {
+		if header == nil {
+			return nil
+		}
+		res, err := tx.Exec(`
+			INSERT INTO ephemeral_transfers (room_id, transfer_id, sender_id, size, chunks, received, created_at, updated_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+			ON CONFLICT (room_id, transfer_id) DO NOTHING
+		`, roomID, transferID, senderID, header.Size, header.Chunks,
+			make([]byte, (header.Chunks+7)/8), now, now)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrTransferExists
+		}
+		return nil
+	}
+	if messageType != TransferChunk && messageType != TransferEnd {
+		return nil
+	}
+
+	var owner string
+	var chunks int
+	var received []byte
+	var completedAt sql.NullInt64
+	err := tx.QueryRow(`
+		SELECT sender_id, chunks, received, completed_at FROM ephemeral_transfers
+		WHERE room_id = ? AND transfer_id = ?
+	`, roomID, transferID).Scan(&owner, &chunks, &received, &completedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner != senderID || completedAt.Valid {
+		return ErrTransferInvalid
+	}
+
+	if messageType == TransferEnd {
+		if len(receivedChunks(received, chunks)) < chunks {
+			return ErrTransferIncomplete
+		}
+		_, err := tx.Exec(`
+			UPDATE ephemeral_transfers SET completed_at = ?, updated_at = ?
+			WHERE room_id = ? AND transfer_id = ?
+		`, now, now, roomID, transferID)
+		return err
+	}
+
+	if header == nil || header.Index < 0 || header.Index >= chunks {
+		return ErrTransferInvalid
+	}
+	bit := byte(1) << (header.Index % 8)
+	if received[header.Index/8]&bit != 0 {
+		return ErrDuplicateChunk
+	}
+	received[header.Index/8] |= bit
+	_, err = tx.Exec(`
+		UPDATE ephemeral_transfers SET received = ?, updated_at = ?
+		WHERE room_id = ? AND transfer_id = ?
+	`, received, now, roomID, transferID)
+	return err
+}
+
+// receivedChunks lists the indexes set in a received bitmap.
+func receivedChunks(bitmap []byte, chunks int) []int {
+	indexes := []int{}
+	for i := 0; i < chunks && i/8 < len(bitmap); i++ {
+		if bitmap[i/8]&(1<<(i%8)) != 0 {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// PendingTransfers returns senderID's incomplete transfers in the room, so
+// a reconnecting sender can resume them.
+func PendingTransfers(db *sql.DB, token, senderID string) ([]Transfer, error) {
+	rows, err := db.Query(`
+		SELECT transfer_id, size, chunks, received FROM ephemeral_transfers
+		WHERE room_id = ? AND sender_id = ? AND completed_at IS NULL
+		ORDER BY created_at
+	`, ID(token), senderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var transfers []Transfer
+	for rows.Next() {
+		var t Transfer
+		var received []byte
+		if err := rows.Scan(&t.ID, &t.Size, &t.Chunks, &received); err != nil {
+			return nil, err
+		}
+		t.Received = receivedChunks(received, t.Chunks)
+		transfers = append(transfers, t)
+	}
+	return transfers, rows.Err()
+}
+
+// CleanupTransfers deletes incomplete transfers that have not received a
+// chunk for timeout, together with their stored messages, and returns them.
+func CleanupTransfers(db *sql.DB, timeout time.Duration) ([]StaleTransfer, error) {
+	cutoff := time.Now().Add(-timeout).Unix()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := tx.Query(`
+		SELECT room_id, transfer_id FROM ephemeral_transfers
+		WHERE completed_at IS NULL AND updated_at <= ?
+	`, cutoff)
+	if err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	var stale []StaleTransfer
+	for rows.Next() {
+		var t StaleTransfer
+		if err := rows.Scan(&t.RoomID, &t.TransferID); err != nil {
+			rows.Close()
+			_ = tx.Rollback()
+			return nil, err
+		}
+		stale = append(stale, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	released := make(map[string][]string)
+	for _, t := range stale {
+		blobs, err := deleteTransferRows(tx, t.RoomID, t.TransferID)
+		if err != nil {
+			_ = tx.Rollback()
+			return nil, err
+		}
+		released[t.RoomID] = append(released[t.RoomID], blobs...)
+	}
+
+	if err := tx.Commit(); err != nil {
+		_ = tx.Rollback()
+		return nil, err
+	}
+
+	for roomID, blobs := range released {
+		removeBlobFiles(roomID, blobs)
+	}
+	return stale, nil
+}
+
+// deleteTransferRows removes a transfer and the messages stored for it,
+// with the blobs they reference, and takes them off the room's usage. It
+// returns the released blob ids for removeBlobFiles.
+func deleteTransferRows(tx *sql.Tx, roomID, transferID string) ([]string, error) {
+	var count int
+	var bytes int64
+	if err := tx.QueryRow(`
+		SELECT COUNT(*), COALESCE(SUM(LENGTH(ciphertext)), 0) FROM ephemeral_messages
+		WHERE room_id = ? AND transfer_id = ?
+		  AND sender_id = (SELECT sender_id FROM ephemeral_transfers WHERE room_id = ? AND transfer_id = ?)
+	`, roomID, transferID, roomID, transferID).Scan(&count, &bytes); err != nil {
+		return nil, err
+	}
+
+	blobs, err := releaseBlobs(tx, roomID, `
+		m.transfer_id = ?
+		AND m.sender_id = (SELECT sender_id FROM ephemeral_transfers WHERE room_id = ? AND transfer_id = ?)
+	`, transferID, roomID, transferID)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		DELETE FROM ephemeral_messages
+		WHERE room_id = ? AND transfer_id = ?
+		  AND sender_id = (SELECT sender_id FROM ephemeral_transfers WHERE room_id = ? AND transfer_id = ?)
+	`, roomID, transferID, roomID, transferID); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE ephemeral_rooms
+		SET message_count = MAX(message_count - ?, 0),
+		    ciphertext_bytes = MAX(ciphertext_bytes - ?, 0)
+		WHERE id = ?
+	`, count, bytes, roomID); err != nil {
+		return nil, err
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM ephemeral_transfers WHERE room_id = ? AND transfer_id = ?
+	`, roomID, transferID)
+	return blobs, err
+}
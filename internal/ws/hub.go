@@ -1,32 +1,189 @@
 package ws
 
-import "sync"
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+)
 
+// Frame is one outbound websocket message. Seq is set for persisted
+// messages, which a lagging connection can recover from the store.
+type Frame struct {
+	Binary bool
+	Data   []byte
+	Seq    int
+}
+
+// Conn is the outbound side of one websocket. Frames travel on two
+// queues: send for room traffic, and control for server notices (errors,
+// acks, presence and the like), which the writer drains first so they are
+// not stuck behind a backlog of messages.
 type Conn struct {
-	send chan []byte
+	id          string
+	participant string
+	send        chan Frame
+	control     chan Frame
+	binary      atomic.Bool
+
+	// Slow-consumer state: frames dropped because the queue was full, and
+	// whether live persisted frames are being skipped during catch-up.
+	dropped    atomic.Uint64
+	lagging    atomic.Bool
+	onOverflow func(f Frame)
+
+	done        chan struct{}
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+	closeMsg    []byte // written after the queues are flushed
 }
 
-func NewConn() *Conn {
+// NewConn returns a connection for one of participant's devices.
+func NewConn(participant string) *Conn {
+	b := make([]byte, 8)
+	rand.Read(b)
 	return &Conn{
-		send: make(chan []byte, 1024), // Increased from 256 to handle large image bursts
+		id:          hex.EncodeToString(b),
+		participant: participant,
+		send:        make(chan Frame, 1024), // Increased from 256 to handle large image bursts
+		control:     make(chan Frame, 256),
+		done:        make(chan struct{}),
 	}
 }
 
-func (c *Conn) Send() <-chan []byte {
+// ID is a random identifier for this connection (one device).
+func (c *Conn) ID() string {
+	return c.id
+}
+
+// Participant is the id of the person this connection belongs to, shared
+// by all of their devices.
+func (c *Conn) Participant() string {
+	return c.participant
+}
+
+func (c *Conn) Send() <-chan Frame {
 	return c.send
 }
 
-func (c *Conn) Enqueue(msg []byte) {
+// Control is the priority queue for server notices.
+func (c *Conn) Control() <-chan Frame {
+	return c.control
+}
+
+// SetBinary records that the client accepts binary frames.
+func (c *Conn) SetBinary(enabled bool) {
+	c.binary.Store(enabled)
+}
+
+// Binary reports whether the client accepts binary frames.
+func (c *Conn) Binary() bool {
+	return c.binary.Load()
+}
+
+// SetOverflowHandler registers fn to run (under the hub lock, so it must
+// not block) whenever a frame is dropped because the queue is full.
+func (c *Conn) SetOverflowHandler(fn func(f Frame)) {
+	c.onOverflow = fn
+}
+
+// Dropped returns how many frames were dropped for this connection.
+func (c *Conn) Dropped() uint64 {
+	return c.dropped.Load()
+}
+
+// StartLagging marks the connection as catching up from the store and
+// reports whether it was previously live.
+func (c *Conn) StartLagging() bool {
+	return c.lagging.CompareAndSwap(false, true)
+}
+
+// StopLagging resumes live delivery of persisted frames.
+func (c *Conn) StopLagging() {
+	c.lagging.Store(false)
+}
+
+// Lagging reports whether the connection is catching up from the store.
+func (c *Conn) Lagging() bool {
+	return c.lagging.Load()
+}
+
+// offer queues f without blocking. Persisted frames are skipped while the
+// connection is lagging; anything else that does not fit counts as dropped.
+func (c *Conn) offer(f Frame) {
+	if f.Seq > 0 && c.lagging.Load() {
+		return
+	}
+	select {
+	case c.send <- f:
+	default:
+		c.dropped.Add(1)
+		if c.onOverflow != nil {
+			c.onOverflow(f)
+		}
+	}
+}
+
+// EnqueueControl queues msg on the priority lane without blocking. A full
+// control queue means the client is not reading at all, so the frame is
+// dropped like any other overflow.
+func (c *Conn) EnqueueControl(msg []byte) {
 	select {
-	case c.send <- msg:
+	case c.control <- Frame{Data: msg}:
 	default:
+		c.dropped.Add(1)
+		if c.onOverflow != nil {
+			c.onOverflow(Frame{Data: msg})
+		}
 	}
 }
 
-// EnqueueReliable blocks until the message is sent or the sender's context is canceled.
+// EnqueueReliable blocks until the message is queued or the connection is closed.
 // Use this for critical messages like history replay where dropping is not acceptable.
 func (c *Conn) EnqueueReliable(msg []byte) {
-	c.send <- msg
+	c.EnqueueFrameReliable(Frame{Data: msg})
+}
+
+// EnqueueFrameReliable is EnqueueReliable for text or binary frames.
+func (c *Conn) EnqueueFrameReliable(f Frame) {
+	select {
+	case c.send <- f:
+	case <-c.done:
+	}
+}
+
+// Close asks the connection's writer to flush queued frames and close the
+// socket with the given status code. Only the first call has any effect.
+func (c *Conn) Close(code int, reason string) {
+	c.closeWith(nil, code, reason)
+}
+
+// closeWith is Close with a final message, written after everything
+// already queued.
+func (c *Conn) closeWith(msg []byte, code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeReason = reason
+		c.closeMsg = msg
+		close(c.done)
+	})
+}
+
+// Done is closed once Close has been called.
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// CloseStatus returns the code and reason passed to Close.
+func (c *Conn) CloseStatus() (int, string) {
+	return c.closeCode, c.closeReason
+}
+
+// CloseMessage returns the final message to send before closing, if any.
+// Like CloseStatus it is only meaningful once Done is closed.
+func (c *Conn) CloseMessage() []byte {
+	return c.closeMsg
 }
 
 type Hub struct {
@@ -53,12 +210,87 @@ func (h *Hub) Remove(c *Conn) {
 	close(c.send)
 }
 
+// Participants returns the distinct participant IDs connected to the hub.
+func (h *Hub) Participants() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seen := make(map[string]bool, len(h.conns))
+	ids := make([]string, 0, len(h.conns))
+	for c := range h.conns {
+		if !seen[c.participant] {
+			seen[c.participant] = true
+			ids = append(ids, c.participant)
+		}
+	}
+	return ids
+}
+
+// Stats describes one connection's queue for monitoring.
+type Stats struct {
+	ID          string `json:"device"`
+	Participant string `json:"peer"`
+	Queued      int    `json:"queued"`
+	Dropped     uint64 `json:"dropped"`
+	Lagging     bool   `json:"lagging"`
+}
+
+// Stats returns queue statistics for every connection in the hub.
+func (h *Hub) Stats() []Stats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := make([]Stats, 0, len(h.conns))
+	for c := range h.conns {
+		stats = append(stats, Stats{
+			ID:          c.id,
+			Participant: c.participant,
+			Queued:      len(c.send) + len(c.control),
+			Dropped:     c.Dropped(),
+			Lagging:     c.Lagging(),
+		})
+	}
+	return stats
+}
+
 func (h *Hub) Broadcast(msg []byte) {
 	h.mu.Lock()
 	for c := range h.conns {
-		select {
-		case c.send <- msg:
-		default:
+		c.offer(Frame{Data: msg})
+	}
+	h.mu.Unlock()
+}
+
+// BroadcastControl sends a server notice on the priority lane of every
+// connection except skip, which may be nil.
+func (h *Hub) BroadcastControl(msg []byte, skip *Conn) {
+	h.mu.Lock()
+	for c := range h.conns {
+		if c == skip {
+			continue
+		}
+		c.EnqueueControl(msg)
+	}
+	h.mu.Unlock()
+}
+
+// BroadcastExceptParticipant sends a server notice on the priority lane
+// of every connection not belonging to participant.
+func (h *Hub) BroadcastExceptParticipant(msg []byte, participant string) {
+	h.mu.Lock()
+	for c := range h.conns {
+		if c.participant != participant {
+			c.EnqueueControl(msg)
+		}
+	}
+	h.mu.Unlock()
+}
+
+// SendToParticipant sends a server notice on the priority lane of every
+// device of participant except skip.
+func (h *Hub) SendToParticipant(participant string, msg []byte, skip *Conn) {
+	h.mu.Lock()
+	for c := range h.conns {
+		if c.participant == participant && c != skip {
+			c.EnqueueControl(msg)
 		}
 	}
 	h.mu.Unlock()
@@ -71,10 +303,36 @@ func (h *Hub) BroadcastExcept(msg []byte, sender *Conn) {
 		if c == sender {
 			continue // Skip the sender
 		}
-		select {
-		case c.send <- msg:
-		default:
+		c.offer(Frame{Data: msg})
+	}
+	h.mu.Unlock()
+}
+
+// BroadcastMessage relays persisted message seq to all connections except
+// the sender, as bin to those that negotiated binary frames (when bin is
+// non-nil) and as text to the rest.
+func (h *Hub) BroadcastMessage(seq int, text, bin []byte, sender *Conn) {
+	h.mu.Lock()
+	for c := range h.conns {
+		if c == sender {
+			continue
+		}
+		f := Frame{Data: text, Seq: seq}
+		if bin != nil && c.Binary() {
+			f = Frame{Binary: true, Data: bin, Seq: seq}
 		}
+		c.offer(f)
 	}
 	h.mu.Unlock()
 }
+
+// CloseAll closes every connection with the given status code, sending msg
+// as each one's final message. It returns the number of connections closed.
+func (h *Hub) CloseAll(msg []byte, code int, reason string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c := range h.conns {
+		c.closeWith(msg, code, reason)
+	}
+	return len(h.conns)
+}
@@ -0,0 +1,3 @@
+-- Creator-only management: hash of the admin secret and lock flag
+ALTER TABLE ephemeral_rooms ADD COLUMN admin_hash TEXT;
+ALTER TABLE ephemeral_rooms ADD COLUMN locked INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- Rooms are keyed by an HMAC of the token instead of the token itself.
+-- The existing values are rewritten by the Go hook registered for this
+-- version (rooms.HashTokens) in the same transaction.
+ALTER TABLE ephemeral_rooms RENAME COLUMN token TO id;
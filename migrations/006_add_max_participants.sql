@@ -0,0 +1,2 @@
+-- Per-room participant cap chosen at creation time
+ALTER TABLE ephemeral_rooms ADD COLUMN max_participants INTEGER NOT NULL DEFAULT 2;
@@ -0,0 +1,5 @@
+-- Optional inactivity timeout (seconds, 0 = disabled) and last activity time
+ALTER TABLE ephemeral_rooms ADD COLUMN idle_timeout INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ephemeral_rooms ADD COLUMN last_activity_at INTEGER;
+
+UPDATE ephemeral_rooms SET last_activity_at = created_at;
@@ -0,0 +1,13 @@
+-- Running totals of persisted messages per room, checked against quotas
+ALTER TABLE ephemeral_rooms ADD COLUMN message_count INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ephemeral_rooms ADD COLUMN ciphertext_bytes INTEGER NOT NULL DEFAULT 0;
+
+UPDATE ephemeral_rooms SET
+  message_count = (
+    SELECT COUNT(*) FROM ephemeral_messages
+    WHERE ephemeral_messages.room_id = ephemeral_rooms.id
+  ),
+  ciphertext_bytes = (
+    SELECT COALESCE(SUM(LENGTH(ciphertext)), 0) FROM ephemeral_messages
+    WHERE ephemeral_messages.room_id = ephemeral_rooms.id
+  );
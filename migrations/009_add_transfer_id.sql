@@ -0,0 +1,2 @@
+-- Plaintext transfer id from the binary frame header (NULL for plain messages)
+ALTER TABLE ephemeral_messages ADD COLUMN transfer_id TEXT;
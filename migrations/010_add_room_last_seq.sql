@@ -0,0 +1,38 @@
+-- Allocate message seqs in the database instead of in server memory
+
+-- Two processes sharing a database could hand out the same seq. The first
+-- message stored under each seq keeps it; the others are renumbered past the
+-- room's highest seq, in the order they were stored, so nothing is lost
+CREATE TEMP TABLE seq_renumber AS
+SELECT m.id AS id,
+       (SELECT MAX(x.seq) FROM ephemeral_messages x WHERE x.room_id = m.room_id)
+         + ROW_NUMBER() OVER (PARTITION BY m.room_id ORDER BY m.id) AS seq
+FROM ephemeral_messages m
+WHERE m.id NOT IN (
+  SELECT MIN(id) FROM ephemeral_messages GROUP BY room_id, seq
+);
+
+UPDATE ephemeral_messages
+SET seq = (SELECT r.seq FROM seq_renumber r WHERE r.id = ephemeral_messages.id)
+WHERE id IN (SELECT id FROM seq_renumber);
+
+DROP TABLE seq_renumber;
+
+DROP INDEX IF EXISTS idx_messages_room_seq;
+CREATE UNIQUE INDEX idx_messages_room_seq ON ephemeral_messages (room_id, seq);
+
+ALTER TABLE ephemeral_rooms ADD COLUMN last_seq INTEGER NOT NULL DEFAULT 0;
+
+UPDATE ephemeral_rooms SET
+  last_seq = (
+    SELECT COALESCE(MAX(seq), 0) FROM ephemeral_messages
+    WHERE ephemeral_messages.room_id = ephemeral_rooms.id
+  ),
+  message_count = (
+    SELECT COUNT(*) FROM ephemeral_messages
+    WHERE ephemeral_messages.room_id = ephemeral_rooms.id
+  ),
+  ciphertext_bytes = (
+    SELECT COALESCE(SUM(LENGTH(ciphertext)), 0) FROM ephemeral_messages
+    WHERE ephemeral_messages.room_id = ephemeral_rooms.id
+  );
@@ -0,0 +1,13 @@
+-- Participants are people, not connections: every device presenting the
+-- same participant key maps to one row, which holds their shared read state
+CREATE TABLE ephemeral_participants (
+  room_id TEXT NOT NULL,
+  participant_id TEXT NOT NULL,
+  read_seq INTEGER NOT NULL DEFAULT 0,
+  joined_at INTEGER NOT NULL,
+  last_seen_at INTEGER NOT NULL,
+  PRIMARY KEY (room_id, participant_id)
+);
+
+-- Server-stamped author of each stored message (NULL for older rows)
+ALTER TABLE ephemeral_messages ADD COLUMN sender_id TEXT;
@@ -0,0 +1,3 @@
+-- Redacted messages keep their row (and seq) as a tombstone with the
+-- nonce and ciphertext emptied
+ALTER TABLE ephemeral_messages ADD COLUMN redacted_at INTEGER;
@@ -0,0 +1,7 @@
+-- Delete-on-delivery rooms drop each message once every participant has
+-- acknowledged it; delivered_seq is a participant's acknowledged high-water mark.
+-- joined_participants counts every participant that ever joined, including
+-- ones since forgotten, so deletion can wait for a second one to arrive
+ALTER TABLE ephemeral_rooms ADD COLUMN delete_on_delivery INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ephemeral_rooms ADD COLUMN joined_participants INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE ephemeral_participants ADD COLUMN delivered_seq INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,16 @@
+-- Image transfers the server can track from their plaintext header: the
+-- expected size and chunk count, and a bitmap of the chunks stored so far
+CREATE TABLE ephemeral_transfers (
+  room_id TEXT NOT NULL,
+  transfer_id TEXT NOT NULL,
+  sender_id TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  chunks INTEGER NOT NULL,
+  received BLOB NOT NULL,
+  created_at INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL,
+  completed_at INTEGER,
+  PRIMARY KEY (room_id, transfer_id)
+);
+
+CREATE INDEX idx_transfers_incomplete ON ephemeral_transfers (updated_at) WHERE completed_at IS NULL;
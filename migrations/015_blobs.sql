@@ -0,0 +1,10 @@
+-- Opaque encrypted blobs uploaded over HTTP, stored per room and deleted
+-- with it. Their contents are files under the blob directory; rows only
+-- record size and owner
+CREATE TABLE ephemeral_blobs (
+  room_id TEXT NOT NULL,
+  id TEXT NOT NULL,
+  size INTEGER NOT NULL,
+  created_at INTEGER NOT NULL,
+  PRIMARY KEY (room_id, id)
+);
@@ -0,0 +1,2 @@
+-- Relay-only rooms forward messages live and never store them
+ALTER TABLE ephemeral_rooms ADD COLUMN relay_only INTEGER NOT NULL DEFAULT 0;
@@ -0,0 +1,4 @@
+-- A message may name the blob it carries the key for; the blob is deleted
+-- when the message is redacted or deleted, and belongs to one message only
+ALTER TABLE ephemeral_messages ADD COLUMN blob_id TEXT;
+CREATE UNIQUE INDEX idx_messages_blob ON ephemeral_messages (room_id, blob_id) WHERE blob_id IS NOT NULL;
@@ -30,15 +30,22 @@
   const roomToken = hashParts[0];
   const urlHasPriv = hash.includes("&priv=");
   let privParam = null;
+  // Creator-only admin secret (never sent over the websocket URL)
+  let adminSecret = null;
+  // Participant key from a device link (see handleWelcome)
+  let participantKeyParam = null;
   for (let i = 1; i < hashParts.length; i++) {
     const part = hashParts[i];
     const eq = part.indexOf("=");
     if (eq === -1) continue;
     const key = part.slice(0, eq);
     const value = part.slice(eq + 1);
-    if (key === "priv") {
+    if (key === "priv" && privParam === null) {
       privParam = value ? decodeURIComponent(value) : null;
-      break;
+    } else if (key === "admin" && adminSecret === null) {
+      adminSecret = value ? decodeURIComponent(value) : null;
+    } else if (key === "pk" && participantKeyParam === null) {
+      participantKeyParam = value ? decodeURIComponent(value) : null;
     }
   }
   if (!roomToken) {
@@ -64,17 +71,28 @@
   // Image transfer limits
   const MAX_IMAGE_BYTES = 5 * 1024 * 1024; // 5 MB hard cap
   const MAX_IMAGE_CHUNK_BYTES = 16 * 1024; // 16 KB raw bytes per chunk (reduced from 32KB)
-  const IMAGE_TRANSFER_TIMEOUT = 60000; // 60s timeout for incomplete transfers
+  const IMAGE_TRANSFER_TIMEOUT = 60000; // 60s without chunks marks a transfer stalled
+  const HISTORY_PAGE_SIZE = 50; // stored messages per replay page
 
   // Expected crypto lengths (for validation)
   const X25519_PUBKEY_BYTES = 32;
   const XCHACHA20_NONCE_BYTES = 24;
+  const BLOB_KEY_BYTES = 32;
   const POLY1305_MAC_BYTES = 16;
 
   // Debug flag
   const DEBUG = false;
 
   // Message type allow-list (UPDATED: added image types)
+  // Types whose seq is a stored message that has now reached us
+  const STORED_SEQ_TYPES = new Set([
+    "MSG",
+    "IMG_META",
+    "IMG_CHUNK",
+    "IMG_END",
+    "REDACTED",
+  ]);
+
   const ALLOWED_MESSAGE_TYPES = new Set([
     "HELLO",
     "READY",
@@ -84,6 +102,21 @@
     "IMG_CHUNK",
     "IMG_END",
     "ERROR",
+    "EXTENDED",
+    "ROOM_DESTROYED",
+    "ROOM_EXPIRED",
+    "EXPIRY_WARNING",
+    "KICKED",
+    "ACK",
+    "WELCOME",
+    "PEER_JOINED",
+    "PEER_LEFT",
+    "HISTORY_BEGIN",
+    "HISTORY_END",
+    "READ_STATE",
+    "REDACTED",
+    "TRANSFER_STATE",
+    "TRANSFER_ABORTED",
   ]);
 
   // Allowed image MIME types
@@ -121,6 +154,7 @@
   const expiryText = document.getElementById("expiry-text");
   const destroyButton = document.getElementById("destroy-btn");
   const progressArea = document.getElementById("progress-area");
+  const presenceStatus = document.getElementById("presence-status");
 
   // Image Modal references
   const imageModal = document.getElementById("image-modal");
@@ -142,14 +176,53 @@
   // WebSocket connection
   let ws = null;
   let lastSeenSeq = 0;
+  // Sent messages awaiting an ACK, by client message id
+  const pendingAcks = new Map();
   let historyReplayActive = false;
   let activeTransfers = 0;
   let replayTimer = null;
+  // Explicit replay window between HISTORY_BEGIN and HISTORY_END
+  let historyInProgress = false;
+  let historyUntilSeq = 0;
+  let historyPageSize = 0;
+  let historyReceived = 0;
 
   // Room expiry state
   let roomExpiresAt = null;
+  // Lowered to the server's limit once WELCOME arrives
+  let maxImageBytes = MAX_IMAGE_BYTES;
+  // How long the server keeps an incomplete transfer (limits.transfer_timeout_sec)
+  let transferTimeoutMs = 10 * 60000;
+  // Set when the server advertises the "blobs" feature; images then go
+  // through /room/{token}/blobs instead of websocket chunks
+  let blobsSupported = false;
+  let maxBlobBytes = 0;
+  // Participant IDs of the other people currently online
+  const onlinePeers = new Set();
+  // Our participant identity, shared by all of our devices in this room
+  let participantKey = participantKeyParam;
+  let myParticipantId = null;
+  let deviceLinkShown = false;
+  // Read position shared by our devices (READ / READ_STATE)
+  let readSeq = 0;
+  let readTimer = null;
+  let unreadCount = 0;
+  const baseTitle = document.title;
+  // Delete-on-delivery rooms: every seq up to deliveredSeq has reached us,
+  // plus any later ones in receivedSeqs (DELIVERED)
+  let deleteOnDelivery = false;
+  // Relay-only rooms store nothing; their messages arrive with seq 0
+  let relayOnly = false;
+  let deliveredSeq = 0;
+  let deliveredSent = 0;
+  const receivedSeqs = new Set();
+  let deliveredTimer = null;
   let expiryCheckInterval = null;
 
+  // Uploads not yet finished, by transfer id (sender side)
+  const outgoingImages = new Map();
+  // id -> { file, bytes, chunkSize, numChunks, socket, busy }
+
   // Image transfer state (receiver side)
   const incomingImages = new Map();
   // id -> { meta, chunks: Map<i, Uint8Array>, receivedBytes, startTime }
@@ -190,7 +263,7 @@
       clearTimeout(replayTimer);
     }
     replayTimer = setTimeout(() => {
-      historyReplayActive = false;
+      if (!historyInProgress) historyReplayActive = false;
     }, 200);
   }
 
@@ -245,6 +318,7 @@
     updateChatLine(line);
     log.appendChild(line);
     log.scrollTop = log.scrollHeight;
+    return line;
   }
 
   function refreshChatLabels() {
@@ -425,6 +499,81 @@
     }
   }
 
+  /**
+   * Apply a new expiry pushed by the server after the room was extended
+   */
+  function handleRoomExtended(data) {
+    if (!data || typeof data.expires_at !== "string") {
+      addWarningLog("Invalid EXTENDED message");
+      return;
+    }
+    const expires = new Date(data.expires_at);
+    if (isNaN(expires.getTime())) {
+      addWarningLog("Invalid EXTENDED expiry");
+      return;
+    }
+    roomExpiresAt = expires;
+    if (expiryBanner) {
+      expiryBanner.style.backgroundColor = "";
+      expiryBanner.style.borderColor = "";
+      expiryBanner.style.color = "";
+    }
+    updateExpiryDisplay();
+    addSystemLog("⏰ Room extended until " + expires.toLocaleString());
+  }
+
+  /**
+   * The server warns that the room expires soon
+   */
+  function handleExpiryWarning(data) {
+    if (!data || typeof data.expires_at !== "string") {
+      addWarningLog("Invalid EXPIRY_WARNING message");
+      return;
+    }
+    const expires = new Date(data.expires_at);
+    if (!isNaN(expires.getTime())) {
+      roomExpiresAt = expires;
+      updateExpiryDisplay();
+    }
+    const minutes = Math.max(1, Math.round((data.expires_in_sec || 0) / 60));
+    addSystemLog(
+      `⏰ Room expires in ${minutes} minute${minutes !== 1 ? "s" : ""}`
+    );
+  }
+
+  /**
+   * The server destroyed the room (deleted by a participant or expired)
+   */
+  function handleRoomDestroyed(data) {
+    const reason = data && typeof data.reason === "string" ? data.reason : "";
+    if (reason === "expired") {
+      showRoomExpired();
+      return;
+    }
+
+    if (expiryCheckInterval) {
+      clearInterval(expiryCheckInterval);
+    }
+    if (expiryBanner && expiryText) {
+      expiryBanner.style.display = "block";
+      expiryBanner.style.backgroundColor = "#ffebee";
+      expiryBanner.style.borderColor = "#f44336";
+      expiryBanner.style.color = "#c62828";
+      expiryText.textContent = "This room has been destroyed";
+    }
+    if (reason === "idle") {
+      if (expiryText) expiryText.textContent = "This room was destroyed after inactivity";
+      addSystemLog("💤 Room destroyed after inactivity");
+    } else {
+      addSystemLog("🔥 Room destroyed");
+    }
+
+    if (form) form.onsubmit = (e) => e.preventDefault();
+    if (input) input.disabled = true;
+    if (imageButton) imageButton.disabled = true;
+    if (destroyButton) destroyButton.disabled = true;
+  }
+
   /**
    * Show room expired state
    */
@@ -597,6 +746,17 @@
     ) {
       throw new Error("Invalid size");
     }
+    if (payload.blob !== undefined) {
+      // Out-of-band image: the bytes live in the room's blob store
+      if (typeof payload.blob !== "string" || !/^[0-9a-f]{32}$/.test(payload.blob)) {
+        throw new Error("Invalid blob id");
+      }
+      if (typeof payload.key !== "string") throw new Error("Missing blob key");
+      if (sodium) {
+        decodeAndValidateBase64(payload.key, BLOB_KEY_BYTES, "IMG_META.key");
+      }
+      return true;
+    }
     if (
       typeof payload.chunkSize !== "number" ||
       payload.chunkSize > MAX_IMAGE_CHUNK_BYTES
@@ -738,7 +898,8 @@
     imageBytes,
     fileName,
     fileSize,
-    senderPubB64 = null
+    senderPubB64 = null,
+    transferId = null
   ) {
     try {
       const blob =
@@ -750,6 +911,7 @@
       const entry = document.createElement("div");
       entry.style.margin = "15px 0";
       entry.style.display = "block";
+      if (transferId) entry.dataset.tid = transferId;
 
       // Create thumbnail wrapper
       const wrapper = document.createElement("div");
@@ -868,12 +1030,13 @@
       return false;
     }
 
-    if (file.size > MAX_IMAGE_BYTES) {
-      addWarningLog(`Image too large (max ${MAX_IMAGE_BYTES / 1024 / 1024}MB)`);
+    if (file.size > maxImageBytes) {
+      addWarningLog(`Image too large (max ${maxImageBytes / 1024 / 1024}MB)`);
       return false;
     }
 
     let transferId; // Declare transferId here for scope in catch block
+    let transfer = null;
     activeTransfers++;
     updateInputState();
 
@@ -885,6 +1048,15 @@
       const arrayBuffer = await file.arrayBuffer();
       const bytes = new Uint8Array(arrayBuffer);
 
+      if (
+        blobsSupported &&
+        !relayOnly &&
+        bytes.length + XCHACHA20_NONCE_BYTES + 16 <= maxBlobBytes
+      ) {
+        await sendImageBlob(file, bytes, transferId);
+        return true;
+      }
+
       // Calculate chunks
       const chunkSize = MAX_IMAGE_CHUNK_BYTES;
       const numChunks = Math.ceil(bytes.length / chunkSize);
@@ -914,6 +1086,10 @@
         !(await sendEnvelope("IMG_META", {
           v: PROTOCOL_VERSION,
           seq: 0, // Server will assign actual seq
+          tid: transferId,
+          // Plaintext header so the server can track (and resume) the transfer
+          size: bytes.length,
+          chunks: numChunks,
           n: metaNonce,
           c: metaCipher,
         }))
@@ -921,6 +1097,10 @@
         throw new Error("Connection lost during metadata phase");
       }
 
+      // Kept until IMG_END is sent, so an interrupted upload can resume
+      transfer = { id: transferId, file, bytes, chunkSize, numChunks, socket: ws, busy: true };
+      outgoingImages.set(transferId, transfer);
+
       updateProgressBar(transferId, 0, `Uploading: ${file.name}`);
 
       // Wait for WebSocket buffer to drain before sending chunks
@@ -928,95 +1108,266 @@
         throw new Error("Connection failed (write buffer full)");
       }
 
-      // Send chunks with connection checks
-      for (let i = 0; i < numChunks; i++) {
-        // Check connection before each chunk
-        if (!ws || ws.readyState !== WebSocket.OPEN) {
-          throw new Error(`Connection lost at chunk ${i}/${numChunks}`);
-        }
+      const all = [];
+      for (let i = 0; i < numChunks; i++) all.push(i);
+      await sendImageChunks(transfer, all);
+      await finishImageTransfer(transfer);
+      return true;
+    } catch (err) {
+      if (transfer && !socketUsable(transfer.socket)) {
+        addWarningLog(`Image upload interrupted: ${err.message}. It will resume after reconnecting.`);
+        updateProgressBar(transferId, 0, `Waiting to resume: ${file.name}`);
+        return false;
+      }
+      addErrorLog(`Image upload failed: ${err.message}. Please try again.`);
+      if (transferId) {
+        outgoingImages.delete(transferId);
+        removeProgressBar(transferId);
+      }
+      return false;
+    } finally {
+      if (transfer) transfer.busy = false;
+      activeTransfers = Math.max(0, activeTransfers - 1);
+      updateInputState();
+    }
+  }
 
-        const start = i * chunkSize;
-        const end = Math.min(start + chunkSize, bytes.length);
-        const chunkBytes = bytes.slice(start, end);
-
-        const chunkPayload = {
-          type: "IMG_CHUNK",
-          id: transferId,
-          i: i,
-          b: sodium.to_base64(chunkBytes),
-        };
-
-        const { nonce: chunkNonce, ciphertext: chunkCipher } =
-          encryptPayload(chunkPayload);
-
-        if (!(await sendEnvelope("IMG_CHUNK", {
-            v: PROTOCOL_VERSION,
-            seq: 0, // Server will assign actual seq
-            n: chunkNonce,
-            c: chunkCipher,
-          }))
-        ) {
-          throw new Error(`Server rejected chunk ${i}/${numChunks}`);
-        }
+  /**
+   * Upload the image to the room's blob store under a fresh key, then send
+   * an IMG_META that carries the blob id and key. The server only ever sees
+   * ciphertext; the key travels inside the room-encrypted META.
+   */
+  async function sendImageBlob(file, bytes, transferId) {
+    addSystemLog(`Sending image: ${file.name} (${(bytes.length / 1024).toFixed(1)}KB)`);
+    updateProgressBar(transferId, 0, `Uploading: ${file.name}`);
 
-        updateProgressBar(transferId, ((i + 1) / numChunks) * 100, `Uploading: ${file.name}`);
+    const key = sodium.randombytes_buf(BLOB_KEY_BYTES);
+    const nonce = sodium.randombytes_buf(XCHACHA20_NONCE_BYTES);
+    const ciphertext = sodium.crypto_aead_xchacha20poly1305_ietf_encrypt(
+      bytes,
+      sodium.from_string(AAD_PREFIX + roomToken),
+      null,
+      nonce,
+      key
+    );
+    const body = new Uint8Array(nonce.length + ciphertext.length);
+    body.set(nonce, 0);
+    body.set(ciphertext, nonce.length);
+
+    const response = await fetch(`/room/${roomToken}/blobs`, {
+      method: "PUT",
+      headers: { "Content-Type": "application/octet-stream" },
+      body,
+    });
+    const result = await response.json().catch(() => ({}));
+    if (!response.ok || typeof result.id !== "string") {
+      throw new Error(result.message || `upload failed (${response.status})`);
+    }
+    updateProgressBar(transferId, 100, `Uploading: ${file.name}`);
+
+    const { nonce: metaNonce, ciphertext: metaCipher } = encryptPayload({
+      type: "IMG_META",
+      id: transferId,
+      name: file.name || "image",
+      mime: file.type,
+      size: bytes.length,
+      blob: result.id,
+      key: sodium.to_base64(key),
+      signature: { publicKey: getLocalPublicKeyB64() },
+    });
+    sodium.memzero(key);
 
-        // Wait for buffer to drain before next chunk
-        if (!(await waitForBufferDrain())) {
-          throw new Error(`Connection stalled at chunk ${i + 1}/${numChunks}`);
-        }
+    // No plaintext size/chunks header: there is nothing for the server to
+    // track. The plaintext blob id lets it delete the blob with the message.
+    if (
+      !(await sendEnvelope("IMG_META", {
+        v: PROTOCOL_VERSION,
+        seq: 0, // Server will assign actual seq
+        tid: transferId,
+        blob: result.id,
+        n: metaNonce,
+        c: metaCipher,
+      }))
+    ) {
+      throw new Error("Connection lost during metadata phase");
+    }
 
-        // Pacing to prevent overwhelming the server buffer or DB transactions
-        await new Promise((resolve) => setTimeout(resolve, 15));
-      }
+    removeProgressBar(transferId);
+    addSystemLog("Image sent successfully");
+    displayImagePreview(
+      file,
+      bytes,
+      file.name,
+      bytes.length,
+      getLocalPublicKeyB64(),
+      transferId
+    );
+  }
 
-      // Final connection check
-      if (!ws || ws.readyState !== WebSocket.OPEN) {
-        throw new Error("Connection lost before IMG_END");
+  // A transfer sticks to the socket it started on; after a reconnect the
+  // server's TRANSFER_STATE says where to pick up
+  function socketUsable(socket) {
+    return ws === socket && ws.readyState === WebSocket.OPEN;
+  }
+
+  /**
+   * Send the given chunk indexes of an outgoing transfer
+   */
+  async function sendImageChunks(transfer, indexes) {
+    const { id, file, bytes, chunkSize, numChunks } = transfer;
+    let sent = numChunks - indexes.length;
+
+    // Send chunks with connection checks
+    for (const i of indexes) {
+      // Check connection before each chunk
+      if (!socketUsable(transfer.socket)) {
+        throw new Error(`Connection lost at chunk ${i}/${numChunks}`);
       }
 
-      // Send IMG_END
-      const endPayload = {
-        type: "IMG_END",
-        id: transferId,
+      const start = i * chunkSize;
+      const end = Math.min(start + chunkSize, bytes.length);
+      const chunkBytes = bytes.slice(start, end);
+
+      const chunkPayload = {
+        type: "IMG_CHUNK",
+        id: id,
+        i: i,
+        b: sodium.to_base64(chunkBytes),
       };
-      const { nonce: endNonce, ciphertext: endCipher } =
-        encryptPayload(endPayload);
 
-      if (
-        !(await sendEnvelope("IMG_END", {
-          v: PROTOCOL_VERSION,
-          seq: 0, // Server will assign actual seq
-          n: endNonce,
-          c: endCipher,
-        }))
-      ) {
-        throw new Error("Failed to finalize image transfer");
+      const { nonce: chunkNonce, ciphertext: chunkCipher } =
+        encryptPayload(chunkPayload);
+
+      if (!(await sendBinaryFrame("IMG_CHUNK", id, chunkNonce, chunkCipher, i))) {
+        throw new Error(`Server rejected chunk ${i}/${numChunks}`);
       }
 
-      removeProgressBar(transferId);
-      addSystemLog("Image sent successfully");
+      sent++;
+      updateProgressBar(id, (sent / numChunks) * 100, `Uploading: ${file.name}`);
 
-      // Display preview for sender too
-      displayImagePreview(
-        file,
-        bytes,
-        file.name,
-        bytes.length,
-        getLocalPublicKeyB64()
-      );
+      // Wait for buffer to drain before next chunk
+      if (!(await waitForBufferDrain())) {
+        throw new Error(`Connection stalled at chunk ${sent}/${numChunks}`);
+      }
 
-      return true;
+      // Pacing to prevent overwhelming the server buffer or DB transactions
+      await new Promise((resolve) => setTimeout(resolve, 15));
+    }
+  }
+
+  /**
+   * Send IMG_END once every chunk is out, then show our own preview
+   */
+  async function finishImageTransfer(transfer) {
+    const { id, file, bytes } = transfer;
+
+    // Final connection check
+    if (!socketUsable(transfer.socket)) {
+      throw new Error("Connection lost before IMG_END");
+    }
+
+    // Send IMG_END
+    const endPayload = {
+      type: "IMG_END",
+      id: id,
+    };
+    const { nonce: endNonce, ciphertext: endCipher } =
+      encryptPayload(endPayload);
+
+    if (
+      !(await sendEnvelope("IMG_END", {
+        v: PROTOCOL_VERSION,
+        seq: 0, // Server will assign actual seq
+        tid: id,
+        n: endNonce,
+        c: endCipher,
+      }))
+    ) {
+      throw new Error("Failed to finalize image transfer");
+    }
+
+    outgoingImages.delete(id);
+    removeProgressBar(id);
+    addSystemLog("Image sent successfully");
+
+    // Display preview for sender too
+    displayImagePreview(
+      file,
+      bytes,
+      file.name,
+      bytes.length,
+      getLocalPublicKeyB64(),
+      id
+    );
+  }
+
+  /**
+   * After a reconnect the server reports which chunks of our unfinished
+   * uploads it has; send the rest. Uploads from before a reload are gone
+   * and left for the server to expire.
+   */
+  async function handleTransferState(data) {
+    if (!data || typeof data.tid !== "string" || !Array.isArray(data.received)) {
+      addWarningLog("Invalid TRANSFER_STATE message");
+      return;
+    }
+    const transfer = outgoingImages.get(data.tid);
+    if (!transfer) return;
+    // Let an upload still running on the old socket notice and stop
+    while (transfer.busy) {
+      await new Promise((resolve) => setTimeout(resolve, 50));
+    }
+    if (!outgoingImages.has(data.tid)) return;
+
+    const have = new Set(data.received);
+    const missing = [];
+    for (let i = 0; i < transfer.numChunks; i++) {
+      if (!have.has(i)) missing.push(i);
+    }
+
+    transfer.busy = true;
+    transfer.socket = ws;
+    activeTransfers++;
+    updateInputState();
+    addSystemLog(`Resuming image upload: ${transfer.file.name} (${missing.length} chunks left)`);
+    try {
+      await sendImageChunks(transfer, missing);
+      await finishImageTransfer(transfer);
     } catch (err) {
-      addErrorLog(`Image upload failed: ${err.message}. Please try again.`);
-      if (transferId) removeProgressBar(transferId);
-      return false;
+      if (!socketUsable(transfer.socket)) {
+        addWarningLog(`Image upload interrupted again: ${err.message}`);
+      } else {
+        addErrorLog(`Image upload failed: ${err.message}. Please try again.`);
+        outgoingImages.delete(transfer.id);
+        removeProgressBar(transfer.id);
+      }
     } finally {
-      activeTransfers--;
+      transfer.busy = false;
+      activeTransfers = Math.max(0, activeTransfers - 1);
       updateInputState();
     }
   }
 
+  /**
+   * The server gave up on an incomplete transfer and deleted it
+   */
+  function handleTransferAborted(data) {
+    if (!data || typeof data.tid !== "string") {
+      addWarningLog("Invalid TRANSFER_ABORTED message");
+      return;
+    }
+    if (outgoingImages.has(data.tid)) {
+      addErrorLog(`Image upload expired before it finished: ${outgoingImages.get(data.tid).file.name}`);
+      outgoingImages.delete(data.tid);
+      removeProgressBar(data.tid);
+    }
+    const transfer = incomingImages.get(data.tid);
+    if (transfer) {
+      addWarningLog("Sender abandoned image: " + transfer.meta.name);
+      dropIncomingImage(data.tid);
+    }
+  }
+
   // =============================================================================
   // IMAGE TRANSFER - RECEIVER SIDE
   // =============================================================================
@@ -1025,6 +1376,8 @@
    * Handle IMG_META message
    */
   function handleImageMeta(data) {
+    const seq = data && typeof data.seq === "number" && data.seq > 0 ? data.seq : 0;
+    let blobFetch = null;
     try {
       validateEncryptedEnvelope(data);
       if (typeof data.seq === "number" && data.seq > lastSeenSeq) {
@@ -1039,6 +1392,11 @@
         return;
       }
 
+      if (payload.blob) {
+        blobFetch = fetchImageBlob(payload);
+        return;
+      }
+
       // Initialize transfer state
       incomingImages.set(payload.id, {
         meta: payload,
@@ -1059,6 +1417,57 @@
       updateProgressBar(payload.id, 0, `Downloading: ${payload.name}`);
     } catch (err) {
       addWarningLog("Invalid IMG_META: " + err.message);
+    } finally {
+      if (seq && blobFetch) {
+        const deliver = () => noteDelivered(seq);
+        blobFetch.then(deliver, deliver);
+      } else if (seq) {
+        noteDelivered(seq);
+      }
+    }
+  }
+
+  /**
+   * Download and decrypt an image announced by a blob IMG_META
+   */
+  async function fetchImageBlob(meta) {
+    updateProgressBar(meta.id, 0, `Downloading: ${meta.name}`);
+    const key = sodium.from_base64(meta.key);
+    try {
+      const response = await fetch(`/room/${roomToken}/blobs/${meta.blob}`);
+      if (!response.ok) {
+        throw new Error(
+          response.status === 404 ? "no longer on the server" : `HTTP ${response.status}`
+        );
+      }
+      const body = new Uint8Array(await response.arrayBuffer());
+      if (body.length <= XCHACHA20_NONCE_BYTES) {
+        throw new Error("truncated blob");
+      }
+      const bytes = sodium.crypto_aead_xchacha20poly1305_ietf_decrypt(
+        null,
+        body.subarray(XCHACHA20_NONCE_BYTES),
+        sodium.from_string(AAD_PREFIX + roomToken),
+        body.subarray(0, XCHACHA20_NONCE_BYTES),
+        key
+      );
+      if (bytes.length !== meta.size) {
+        throw new Error("size mismatch");
+      }
+
+      displayImagePreview(
+        { type: meta.mime },
+        bytes,
+        meta.name,
+        meta.size,
+        extractSenderPublicKey(meta),
+        meta.id
+      );
+    } catch (err) {
+      addWarningLog(`Failed to load image "${meta.name}": ${err.message}`);
+    } finally {
+      sodium.memzero(key);
+      removeProgressBar(meta.id);
     }
   }
 
@@ -1068,8 +1477,8 @@
   function handleImageChunk(data) {
     try {
       validateEncryptedEnvelope(data);
-      // Detect replay FIRST
-      if (typeof data.seq === "number" && data.seq <= lastSeenSeq) {
+      // Detect replay FIRST (seq 0 was relayed live without being stored)
+      if (typeof data.seq === "number" && data.seq > 0 && data.seq <= lastSeenSeq) {
         noteReplayActivity();
       }
 
@@ -1098,6 +1507,13 @@
         return;
       }
 
+      // A resumed transfer blocks the input again until it finishes
+      if (transfer.stalled) {
+        transfer.stalled = false;
+        activeTransfers++;
+        updateInputState();
+      }
+
       // Decode and store chunk
       const chunkBytes = sodium.from_base64(payload.b);
       transfer.chunks.set(payload.i, chunkBytes);
@@ -1141,12 +1557,7 @@
       addErrorLog(
         `Received incomplete image "${transfer.meta.name}" (${transfer.chunks.size}/${transfer.meta.chunks} chunks). The sender might have been disconnected or overwhelmed.`
       );
-      removeProgressBar(payload.id);
-      if (incomingImages.has(payload.id)) {
-        incomingImages.delete(payload.id);
-        activeTransfers = Math.max(0, activeTransfers - 1);
-        updateInputState();
-      }
+      dropIncomingImage(payload.id);
       return;
     }
 
@@ -1157,12 +1568,7 @@
       const chunk = transfer.chunks.get(i);
       if (!chunk) {
         addErrorLog(`Failed to assemble image: missing chunk ${i + 1}`);
-        if (incomingImages.has(payload.id)) {
-          incomingImages.delete(payload.id);
-          activeTransfers = Math.max(0, activeTransfers - 1);
-          updateInputState();
-        }
-        removeProgressBar(payload.id);
+        dropIncomingImage(payload.id);
         return;
       }
       imageBytes.set(chunk, offset);
@@ -1178,16 +1584,12 @@
       imageBytes,
       transfer.meta.name,
       transfer.meta.size,
-      extractSenderPublicKey(transfer.meta)
+      extractSenderPublicKey(transfer.meta),
+      payload.id
     );
 
     // Cleanup
-    if (incomingImages.has(payload.id)) {
-      incomingImages.delete(payload.id);
-      activeTransfers = Math.max(0, activeTransfers - 1);
-      updateInputState();
-    }
-    removeProgressBar(payload.id);
+    dropIncomingImage(payload.id);
     } catch (err) {
       addWarningLog("Invalid IMG_END: " + err.message);
     }
@@ -1202,15 +1604,43 @@
     transfer.startTime = Date.now();
   }
 
+  /**
+   * A stalled transfer (sender gone quiet) stops blocking the input but
+   * keeps its chunks in case the sender resumes, until the server's own
+   * transfer timeout has passed.
+   */
+  function stallIncomingImage(id) {
+    const transfer = incomingImages.get(id);
+    if (!transfer || transfer.stalled) return;
+    transfer.stalled = true;
+    activeTransfers = Math.max(0, activeTransfers - 1);
+    updateInputState();
+    updateProgressBar(
+      id,
+      (transfer.chunks.size / transfer.meta.chunks) * 100,
+      `Waiting for sender: ${transfer.meta.name}`
+    );
+  }
+
+  function dropIncomingImage(id) {
+    const transfer = incomingImages.get(id);
+    if (!transfer) return;
+    incomingImages.delete(id);
+    removeProgressBar(id);
+    if (!transfer.stalled) {
+      activeTransfers = Math.max(0, activeTransfers - 1);
+      updateInputState();
+    }
+  }
+
   function cleanupStaleImageTransfers() {
     const now = Date.now();
     for (const [id, transfer] of incomingImages.entries()) {
-      if (now - transfer.startTime > IMAGE_TRANSFER_TIMEOUT) {
+      if (now - transfer.startTime > transferTimeoutMs) {
         addWarningLog("Image transfer timeout: " + transfer.meta.name);
-        removeProgressBar(id);
-        incomingImages.delete(id);
-        activeTransfers = Math.max(0, activeTransfers - 1);
-        updateInputState();
+        dropIncomingImage(id);
+      } else if (now - transfer.startTime > IMAGE_TRANSFER_TIMEOUT) {
+        stallIncomingImage(id);
       }
     }
   }
@@ -1249,6 +1679,90 @@
     return true;
   }
 
+  // Binary frame layout (see internal/httpx/frame.go):
+  // [type u8][seq u32 BE][tidLen u8][tid][nonceLen u8][nonce][ciphertext]
+  const FRAME_TYPE_CODES = { MSG: 1, IMG_META: 2, IMG_CHUNK: 3, IMG_END: 4 };
+  const FRAME_TYPE_NAMES = { 1: "MSG", 2: "IMG_META", 3: "IMG_CHUNK", 4: "IMG_END" };
+  // Set on server frames that carry the sender's participant ID
+  const FRAME_FLAG_FROM = 0x80;
+  const FRAME_FLAG_TRANSFER = 0x40; // client → server only
+
+  /**
+   * Send an encrypted payload as a binary frame instead of base64 JSON
+   */
+  async function sendBinaryFrame(type, transferId, nonceB64, ciphertextB64, chunkIndex) {
+    if (!ws || ws.readyState !== WebSocket.OPEN) {
+      addWarningLog("Cannot send (not connected)");
+      return false;
+    }
+
+    const tid = sodium.from_string(transferId || "");
+    const nonce = sodium.from_base64(nonceB64);
+    const ciphertext = sodium.from_base64(ciphertextB64);
+    // Chunks carry their index in plaintext so the server can track them
+    const header = typeof chunkIndex === "number" ? 4 : 0;
+    const frame = new Uint8Array(7 + tid.length + header + nonce.length + ciphertext.length);
+    const view = new DataView(frame.buffer);
+    let offset = 0;
+    frame[offset++] = FRAME_TYPE_CODES[type] | (header ? FRAME_FLAG_TRANSFER : 0);
+    offset += 4; // seq is assigned by the server
+    frame[offset++] = tid.length;
+    frame.set(tid, offset);
+    offset += tid.length;
+    if (header) {
+      view.setUint32(offset, chunkIndex);
+      offset += 4;
+    }
+    frame[offset++] = nonce.length;
+    frame.set(nonce, offset);
+    offset += nonce.length;
+    frame.set(ciphertext, offset);
+
+    if (frame.length > MAX_WS_MESSAGE_BYTES) {
+      addWarningLog(
+        `Message too large (${frame.length} bytes, max ${MAX_WS_MESSAGE_BYTES})`
+      );
+      return false;
+    }
+
+    ws.send(frame);
+    return true;
+  }
+
+  /**
+   * Turn a binary frame into the same envelope shape as a JSON message
+   */
+  function decodeBinaryFrame(bytes) {
+    const view = new DataView(bytes.buffer, bytes.byteOffset, bytes.byteLength);
+    const type = FRAME_TYPE_NAMES[bytes[0] & ~FRAME_FLAG_FROM];
+    if (!type || bytes.length < 7) throw new Error("bad frame header");
+    let offset = 5;
+    let from;
+    if (bytes[0] & FRAME_FLAG_FROM) {
+      const fromLen = bytes[offset++];
+      from = sodium.to_string(bytes.subarray(offset, offset + fromLen));
+      offset += fromLen;
+    }
+    const tidLen = bytes[offset++];
+    const tid = sodium.to_string(bytes.subarray(offset, offset + tidLen));
+    offset += tidLen;
+    const nonceLen = bytes[offset++];
+    if (offset + nonceLen >= bytes.length) throw new Error("truncated frame");
+    const nonce = bytes.subarray(offset, offset + nonceLen);
+    const ciphertext = bytes.subarray(offset + nonceLen);
+    return {
+      t: type,
+      from: from,
+      d: {
+        v: PROTOCOL_VERSION,
+        seq: view.getUint32(1),
+        tid: tid,
+        n: sodium.to_base64(nonce),
+        c: sodium.to_base64(ciphertext),
+      },
+    };
+  }
+
   /**
    * Wait for WebSocket buffer to drain (helper for large transfers)
    */
@@ -1306,6 +1820,9 @@
     await sendEnvelope("READY", {
       v: PROTOCOL_VERSION,
       lastSeenSeq: lastSeenSeq,
+      frames: "binary",
+      history_page: HISTORY_PAGE_SIZE,
+      history_window: 2,
     });
     debugLog("Sent READY with lastSeenSeq=" + lastSeenSeq);
   }
@@ -1318,13 +1835,16 @@
 
     try {
       const { nonce, ciphertext } = encryptMessage(text);
-      await sendEnvelope("MSG", {
+      const id = sodium.to_hex(sodium.randombytes_buf(8));
+      const sent = await sendEnvelope("MSG", {
         v: PROTOCOL_VERSION,
+        id: id,
         seq: 0, // Server will assign actual seq
         n: nonce,
         c: ciphertext,
       });
-      addChatLine(text, getLocalPublicKeyB64());
+      const line = addChatLine(text, getLocalPublicKeyB64(), "(sending)");
+      if (sent) pendingAcks.set(id, line);
       return true;
     } catch (err) {
       addLog("[error] Encryption failed: " + err.message, true);
@@ -1411,14 +1931,20 @@
     }
   }
 
-  function handleEncryptedMessage(data) {
+  function handleEncryptedMessage(data, from) {
     try {
       validateEncryptedEnvelope(data);
       if (typeof data.seq === "number" && data.seq > lastSeenSeq) {
         lastSeenSeq = data.seq;
       }
       const payload = decryptMessage(data.n, data.c);
-      addChatLine(payload.text, payload.pub);
+      const ownDevice = from !== undefined && from === myParticipantId;
+      const line = addChatLine(payload.text, payload.pub, ownDevice ? "[your other device]" : "");
+      if (typeof data.seq === "number" && data.seq > 0) {
+        line.dataset.seq = String(data.seq);
+        if (ownDevice) enableUnsend(line);
+      }
+      noteMessageSeen(data.seq, ownDevice);
     } catch (err) {
       addWarningLog("Failed to decrypt message: " + err.message);
       addChatLine("[encrypted message - decryption failed]", null);
@@ -1441,6 +1967,331 @@
     }
   }
 
+  /**
+   * First message from the server: supported versions, limits and room state
+   */
+  function handleWelcome(data) {
+    if (!data || !Array.isArray(data.versions)) {
+      addWarningLog("Invalid WELCOME message");
+      return;
+    }
+    if (!data.versions.includes(PROTOCOL_VERSION)) {
+      addErrorLog(
+        `Server does not support protocol v${PROTOCOL_VERSION} (supports ${data.versions.join(", ")})`
+      );
+      return;
+    }
+    const limits = data.limits || {};
+    if (typeof limits.max_image_bytes === "number" && limits.max_image_bytes > 0) {
+      maxImageBytes = Math.min(MAX_IMAGE_BYTES, limits.max_image_bytes);
+    }
+    if (typeof limits.transfer_timeout_sec === "number" && limits.transfer_timeout_sec > 0) {
+      transferTimeoutMs = limits.transfer_timeout_sec * 1000;
+    }
+    blobsSupported = Array.isArray(data.features) && data.features.includes("blobs");
+    if (typeof limits.max_blob_bytes === "number" && limits.max_blob_bytes > 0) {
+      maxBlobBytes = limits.max_blob_bytes;
+    }
+    const room = data.room || {};
+    onlinePeers.clear();
+    if (Array.isArray(room.peers)) {
+      room.peers.forEach((peer) => onlinePeers.add(peer));
+    }
+    updatePresence();
+    if (typeof room.expires_at === "string") {
+      const expires = new Date(room.expires_at);
+      if (!isNaN(expires.getTime())) {
+        roomExpiresAt = expires;
+        updateExpiryDisplay();
+      }
+    }
+    if (typeof data.peer_id === "string") {
+      myParticipantId = data.peer_id;
+    }
+    if (typeof data.participant_key === "string") {
+      participantKey = data.participant_key;
+    }
+    saveParticipantKey();
+    if (typeof data.read_seq === "number" && data.read_seq > readSeq) {
+      readSeq = data.read_seq;
+    }
+    if (room.delete_on_delivery === true && !deleteOnDelivery) {
+      addSystemLog("Messages are deleted from the server once everyone has received them");
+    }
+    deleteOnDelivery = room.delete_on_delivery === true;
+    if (room.persist === false && !relayOnly) {
+      addSystemLog("Nothing is stored on the server: messages are relayed live only, with no history");
+    }
+    relayOnly = room.persist === false;
+    if (typeof data.delivered_seq === "number") {
+      deliveredSent = data.delivered_seq;
+      noteDeliveredThrough(data.delivered_seq);
+    }
+    scheduleDeliveredUpdate();
+    showDeviceLink();
+    debugLog("WELCOME: features=" + (data.features || []).join(","));
+  }
+
+  /**
+   * Participant keys are remembered per room (under a hash of the token)
+   * so reloads and new tabs count as the same participant.
+   */
+  function participantKeyStorageName() {
+    return "ephemeral.pk." + sodium.to_hex(sodium.crypto_generichash(16, roomToken));
+  }
+
+  function loadParticipantKey() {
+    if (participantKey || !sodium) return;
+    try {
+      participantKey = localStorage.getItem(participantKeyStorageName());
+    } catch (err) {
+      debugLog("localStorage unavailable: " + err.message);
+    }
+  }
+
+  function saveParticipantKey() {
+    if (!participantKey || !sodium) return;
+    try {
+      localStorage.setItem(participantKeyStorageName(), participantKey);
+    } catch (err) {
+      debugLog("localStorage unavailable: " + err.message);
+    }
+  }
+
+  function showDeviceLink() {
+    if (deviceLinkShown || !participantKey) return;
+    deviceLinkShown = true;
+    const link =
+      location.origin + "/#" + roomToken + "&pk=" + encodeURIComponent(participantKey);
+    addSystemLog("To join as you from another device, open: " + link);
+  }
+
+  /**
+   * Read state: while the page is visible we report what we've seen, and
+   * other devices of ours do the same, so unread counts stay in sync.
+   */
+  function noteMessageSeen(seq, ownDevice) {
+    if (typeof seq !== "number" || seq <= readSeq) return;
+    if (document.visibilityState !== "visible" && !ownDevice) {
+      unreadCount++;
+      updateUnreadTitle();
+      return;
+    }
+    scheduleReadUpdate();
+  }
+
+  function scheduleReadUpdate() {
+    if (readTimer) return;
+    readTimer = setTimeout(async () => {
+      readTimer = null;
+      if (lastSeenSeq > readSeq && (await sendEnvelope("READ", { seq: lastSeenSeq }))) {
+        readSeq = lastSeenSeq;
+      }
+    }, 500);
+  }
+
+  function handleReadState(data) {
+    if (!data || typeof data.seq !== "number") {
+      addWarningLog("Invalid READ_STATE message");
+      return;
+    }
+    if (data.seq > readSeq) readSeq = data.seq;
+    if (readSeq >= lastSeenSeq) {
+      unreadCount = 0;
+      updateUnreadTitle();
+    }
+  }
+
+  /**
+   * Delivery acknowledgements let delete-on-delivery rooms drop messages
+   * from the server. Seqs are gap-free, so we only ever acknowledge the
+   * point up to which we have received everything.
+   */
+  function noteDelivered(seq) {
+    if (seq <= deliveredSeq) return;
+    receivedSeqs.add(seq);
+    while (receivedSeqs.delete(deliveredSeq + 1)) {
+      deliveredSeq++;
+    }
+    scheduleDeliveredUpdate();
+  }
+
+  function noteDeliveredThrough(seq) {
+    if (seq <= deliveredSeq) return;
+    deliveredSeq = seq;
+    receivedSeqs.forEach((s) => {
+      if (s <= deliveredSeq) receivedSeqs.delete(s);
+    });
+    while (receivedSeqs.delete(deliveredSeq + 1)) {
+      deliveredSeq++;
+    }
+    scheduleDeliveredUpdate();
+  }
+
+  function scheduleDeliveredUpdate() {
+    if (!deleteOnDelivery || deliveredTimer || deliveredSeq <= deliveredSent) return;
+    deliveredTimer = setTimeout(async () => {
+      deliveredTimer = null;
+      const seq = deliveredSeq;
+      if (seq > deliveredSent && (await sendEnvelope("DELIVERED", { seq: seq }))) {
+        deliveredSent = seq;
+      }
+    }, 500);
+  }
+
+  function updateUnreadTitle() {
+    document.title = unreadCount > 0 ? `(${unreadCount}) ${baseTitle}` : baseTitle;
+  }
+
+  document.addEventListener("visibilitychange", () => {
+    if (document.visibilityState !== "visible") return;
+    unreadCount = 0;
+    updateUnreadTitle();
+    scheduleReadUpdate();
+  });
+
+  /**
+   * History replay framing. We ask for pages with HISTORY_MORE as we
+   * consume them, keeping one page in flight (see sendReady).
+   */
+  function handleHistoryBegin(data) {
+    if (!data || typeof data.count !== "number") {
+      addWarningLog("Invalid HISTORY_BEGIN message");
+      return;
+    }
+    historyInProgress = data.count > 0;
+    historyReplayActive = historyInProgress;
+    historyUntilSeq = data.until_seq || 0;
+    historyPageSize = data.flow ? data.page_size || 0 : 0;
+    historyReceived = 0;
+    if (data.count > 0) {
+      addSystemLog(`Replaying ${data.count} message${data.count !== 1 ? "s" : ""}…`);
+    }
+  }
+
+  function noteHistoryMessage(seq) {
+    if (!historyInProgress || seq > historyUntilSeq) return;
+    historyReceived++;
+    if (historyPageSize > 0 && historyReceived % historyPageSize === 0) {
+      sendEnvelope("HISTORY_MORE", { pages: 1 });
+    }
+  }
+
+  function handleHistoryEnd(data) {
+    const wasReplaying = historyInProgress;
+    historyInProgress = false;
+    historyReplayActive = false;
+    if (data && typeof data.last_seq === "number" && data.last_seq > lastSeenSeq) {
+      lastSeenSeq = data.last_seq;
+    }
+    // Replay has sent everything stored up to last_seq
+    if (data && typeof data.last_seq === "number") {
+      noteDeliveredThrough(data.last_seq);
+    }
+    if (wasReplaying) addSystemLog("History replay complete");
+  }
+
+  /**
+   * Track who else is connected from PEER_JOINED / PEER_LEFT
+   */
+  function handlePresence(type, data) {
+    if (!data || typeof data.peer !== "string") {
+      addWarningLog(`Invalid ${type} message`);
+      return;
+    }
+    if (type === "PEER_JOINED") {
+      onlinePeers.add(data.peer);
+      addSystemLog("👤 A participant joined");
+    } else {
+      onlinePeers.delete(data.peer);
+      addSystemLog("👤 A participant left");
+    }
+    updatePresence();
+  }
+
+  function updatePresence() {
+    if (!presenceStatus) return;
+    presenceStatus.style.display = "block";
+    const count = onlinePeers.size;
+    presenceStatus.classList.toggle("online", count > 0);
+    presenceStatus.textContent =
+      count === 0
+        ? "⚪ Nobody else is online"
+        : `🟢 ${count} other participant${count !== 1 ? "s" : ""} online`;
+  }
+
+  /**
+   * The server stored one of our messages; mark it delivered
+   */
+  function handleAck(data) {
+    if (!data || typeof data.seq !== "number") {
+      addWarningLog("Invalid ACK message");
+      return;
+    }
+    if (data.seq > lastSeenSeq) {
+      lastSeenSeq = data.seq;
+    }
+    // Our own messages are never relayed back, so the ACK is their delivery
+    if (data.seq > 0) {
+      noteDelivered(data.seq);
+    }
+    const line = pendingAcks.get(data.id);
+    if (!line) return;
+    pendingAcks.delete(data.id);
+    line.dataset.suffix = "✓";
+    updateChatLine(line);
+    // Seq 0: relayed but not stored, so there is nothing to unsend
+    if (data.seq > 0) {
+      line.dataset.seq = String(data.seq);
+      enableUnsend(line);
+    }
+  }
+
+  /**
+   * Unsend: double-clicking one of our stored messages asks the server to
+   * redact it for everyone (REDACT), who then get REDACTED.
+   */
+  function enableUnsend(line) {
+    line.title = "Double-click to unsend";
+    line.ondblclick = () => {
+      const seq = Number(line.dataset.seq);
+      if (!seq || line.dataset.redacted) return;
+      if (!confirm("Unsend this message for everyone?")) return;
+      sendEnvelope("REDACT", { seq: seq });
+    };
+  }
+
+  function handleRedacted(data) {
+    if (!data || typeof data.seq !== "number") {
+      addWarningLog("Invalid REDACTED message");
+      return;
+    }
+    if (data.seq > lastSeenSeq) {
+      lastSeenSeq = data.seq;
+    }
+    const line = log.querySelector(`div[data-seq="${data.seq}"]`);
+    if (line) {
+      line.dataset.text = "[message removed]";
+      line.dataset.redacted = "1";
+      delete line.dataset.suffix;
+      line.title = "";
+      line.ondblclick = null;
+      updateChatLine(line);
+    }
+    if (typeof data.tid === "string" && data.tid) {
+      log.querySelectorAll("div[data-tid]").forEach((entry) => {
+        if (entry.dataset.tid === data.tid) {
+          entry.textContent = "[image removed]";
+        }
+      });
+      dropIncomingImage(data.tid);
+      if (outgoingImages.has(data.tid)) {
+        outgoingImages.delete(data.tid);
+        removeProgressBar(data.tid);
+      }
+    }
+  }
+
   function handleErrorMessage(data) {
     if (!data || typeof data !== "object") {
       addWarningLog("Invalid ERROR message");
@@ -1448,21 +2299,37 @@
     }
     const code = data.code || "UNKNOWN";
     const message = data.message || "protocol error";
+    if (code === "RATE_LIMITED") {
+      const seconds = Math.max(1, Math.ceil((Number(data.retry_after_ms) || 0) / 1000));
+      addWarningLog(`Sending too fast; the last message was dropped. Wait ${seconds}s`);
+      return;
+    }
+    // Rejections of our own messages echo the id we sent with them
+    const line = typeof data.id === "string" ? pendingAcks.get(data.id) : null;
+    if (line) {
+      pendingAcks.delete(data.id);
+      line.dataset.suffix = "(not sent)";
+      updateChatLine(line);
+    }
     addWarningLog(`[server error] ${code}: ${message}`);
   }
 
   async function handleMessage(event) {
     try {
-      if (event.data.length > MAX_WS_MESSAGE_BYTES) {
+      const isBinary = event.data instanceof ArrayBuffer;
+      const size = isBinary ? event.data.byteLength : event.data.length;
+      if (size > MAX_WS_MESSAGE_BYTES) {
         addWarningLog("Oversized message ignored (exceeds size limit)");
         return;
       }
 
       let envelope;
       try {
-        envelope = JSON.parse(event.data);
+        envelope = isBinary
+          ? decodeBinaryFrame(new Uint8Array(event.data))
+          : JSON.parse(event.data);
       } catch (err) {
-        addWarningLog("Invalid JSON (ignored)");
+        addWarningLog(isBinary ? "Invalid binary frame (ignored)" : "Invalid JSON (ignored)");
         return;
       }
 
@@ -1474,13 +2341,21 @@
       }
       
       const replaySeq =
-        envelope.d && typeof envelope.d.seq === "number"
+        envelope.d && typeof envelope.d.seq === "number" && envelope.d.seq > 0
           ? envelope.d.seq
           : null;
 
       if (replaySeq !== null && replaySeq <= lastSeenSeq) {
         noteReplayActivity();
       }
+      if (replaySeq !== null) {
+        noteHistoryMessage(replaySeq);
+      }
+      // IMG_META is acknowledged by handleImageMeta: a blob image only once
+      // it is downloaded, since delivery may delete the blob
+      if (replaySeq !== null && STORED_SEQ_TYPES.has(envelope.t) && envelope.t !== "IMG_META") {
+        noteDelivered(replaySeq);
+      }
 
       switch (envelope.t) {
         case "HELLO":
@@ -1490,7 +2365,7 @@
           handleReady(envelope.d);
           break;
         case "MSG":
-          handleEncryptedMessage(envelope.d);
+          handleEncryptedMessage(envelope.d, envelope.from);
           break;
         case "CHAT":
           handlePlaintextMessage(envelope.d);
@@ -1504,9 +2379,52 @@
         case "IMG_END":
           handleImageEnd(envelope.d);
           break;
+        case "WELCOME":
+          handleWelcome(envelope.d);
+          break;
+        case "HISTORY_BEGIN":
+          handleHistoryBegin(envelope.d);
+          break;
+        case "HISTORY_END":
+          handleHistoryEnd(envelope.d);
+          break;
+        case "PEER_JOINED":
+        case "PEER_LEFT":
+          handlePresence(envelope.t, envelope.d);
+          break;
+        case "ACK":
+          handleAck(envelope.d);
+          break;
         case "ERROR":
           handleErrorMessage(envelope.d);
           break;
+        case "EXTENDED":
+          handleRoomExtended(envelope.d);
+          break;
+        case "ROOM_DESTROYED":
+          handleRoomDestroyed(envelope.d);
+          break;
+        case "ROOM_EXPIRED":
+          showRoomExpired();
+          break;
+        case "EXPIRY_WARNING":
+          handleExpiryWarning(envelope.d);
+          break;
+        case "READ_STATE":
+          handleReadState(envelope.d);
+          break;
+        case "REDACTED":
+          handleRedacted(envelope.d);
+          break;
+        case "TRANSFER_STATE":
+          handleTransferState(envelope.d);
+          break;
+        case "TRANSFER_ABORTED":
+          handleTransferAborted(envelope.d);
+          break;
+        case "KICKED":
+          addSystemLog("⛔ Disconnected by the room creator");
+          break;
         default:
           addWarningLog("Unknown message type (ignored): " + envelope.t);
       }
@@ -1522,10 +2440,17 @@
 
   function connectWebSocket() {
     const wsProtocol = location.protocol === "https:" ? "wss://" : "ws://";
+    loadParticipantKey();
     const wsUrl =
       wsProtocol + location.host + "/ws/" + roomToken + "?after_seq=" + lastSeenSeq;
+    // The device key rides in a subprotocol so it stays out of URLs and logs
+    const protocols = ["ephemeral"];
+    if (participantKey) {
+      protocols.push("ephemeral.pk." + participantKey);
+    }
 
-    ws = new WebSocket(wsUrl);
+    ws = new WebSocket(wsUrl, protocols);
+    ws.binaryType = "arraybuffer";
 
     ws.onopen = async function () {
       addLog("[connected]");
@@ -1547,12 +2472,28 @@
       addLog("[error: " + (err.message || "connection failed") + "]", true);
     };
 
-    ws.onclose = function () {
+    ws.onclose = function (event) {
       addLog("[disconnected]");
-      // Reset active transfers on disconnect to avoid stuck UI
+      onlinePeers.clear();
+      if (presenceStatus) presenceStatus.style.display = "none";
+      if (event.code === 4003) {
+        addErrorLog("Server refused this client's protocol version; please reload");
+      }
+      if (event.code === 4005) {
+        addErrorLog("Disconnected for sending too fast");
+      }
+      if (event.code === 4004) {
+        // Dropped for falling behind; reconnect and resume from lastSeenSeq
+        addWarningLog("Connection fell behind; resyncing");
+        setTimeout(connectWebSocket, 1000);
+      }
+      // Don't leave the UI stuck; incoming images wait for their sender
+      // to resume after we reconnect
+      for (const id of incomingImages.keys()) {
+        stallIncomingImage(id);
+      }
       if (activeTransfers > 0) {
         activeTransfers = 0;
-        incomingImages.clear();
         updateInputState();
       }
     };
@@ -1628,8 +2569,12 @@
     };
   }
 
-  // Destroy room button
-  if (destroyButton) {
+  // Destroy room button (only the creator link carries the admin secret)
+  if (destroyButton && !adminSecret) {
+    destroyButton.disabled = true;
+    destroyButton.title = "Only the room creator can destroy this room";
+  }
+  if (destroyButton && adminSecret) {
     destroyButton.onclick = async function () {
       if (!confirm("⚠️ Permanently delete this room and all messages?\n\nThis action cannot be undone!")) {
         return;
@@ -1638,6 +2583,7 @@
       try {
         const response = await fetch(`/room/${roomToken}`, {
           method: "DELETE",
+          headers: { Authorization: "Bearer " + adminSecret },
         });
 
         if (response.ok) {